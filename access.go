@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// An access restricts the requests for the pages of an import in serve
+// mode.  A request is allowed if it comes from one of the networks, or
+// has one of the basic auth credentials or bearer tokens.
+type access struct {
+	nets   []*net.IPNet
+	basic  []string // user:password
+	tokens []string
+}
+
+// newAccess returns the access restrictions of the resolved entry e,
+// or nil if it is not restricted.
+func newAccess(e *entry) (*access, error) {
+	a := &access{basic: e.BasicAuth, tokens: e.BearerToken}
+	if e.Allow != nil {
+		for _, s := range strings.Fields(*e.Allow) {
+			if !strings.Contains(s, "/") {
+				if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+					s += "/32"
+				} else {
+					s += "/128"
+				}
+			}
+			_, n, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, err
+			}
+			a.nets = append(a.nets, n)
+		}
+	}
+	for _, b := range a.basic {
+		if !strings.Contains(b, ":") {
+			return nil, fmt.Errorf("basic-auth %q is not user:password", b)
+		}
+	}
+	if a.nets == nil && a.basic == nil && a.tokens == nil {
+		return nil, nil
+	}
+	return a, nil
+}
+
+// allowed reports whether the request r may see the page.
+func (a *access) allowed(r *http.Request) bool {
+	if a == nil {
+		return true
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			for _, n := range a.nets {
+				if n.Contains(ip) {
+					return true
+				}
+			}
+		}
+	}
+	if user, pass, ok := r.BasicAuth(); ok {
+		for _, b := range a.basic {
+			if secretEqual(user+":"+pass, b) {
+				return true
+			}
+		}
+	}
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		for _, t := range a.tokens {
+			if secretEqual(strings.TrimPrefix(h, "Bearer "), t) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// deny answers a request that is not allowed: with 401 Unauthorized if
+// credentials could help, otherwise with 404 Not Found, so the page
+// stays hidden.
+func (a *access) deny(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case a.basic != nil:
+		w.Header().Set("WWW-Authenticate", `Basic realm="govanity"`)
+	case a.tokens != nil:
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+}
+
+// secretEqual compares the secrets s and t in constant time.
+func secretEqual(s, t string) bool {
+	return subtle.ConstantTimeCompare([]byte(s), []byte(t)) == 1
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestAccess(t *testing.T, allow string, basic, tokens []string) *access {
+	t.Helper()
+	e := &entry{BasicAuth: basic, BearerToken: tokens}
+	if allow != "" {
+		e.Allow = &allow
+	}
+	a, err := newAccess(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestNewAccess(t *testing.T) {
+	if a := newTestAccess(t, "", nil, nil); a != nil {
+		t.Errorf("newAccess without restrictions = %+v, want nil", a)
+	}
+	a := newTestAccess(t, "10.0.0.0/8 192.168.1.1 ::1 fd00::/8", nil, nil)
+	want := []string{"10.0.0.0/8", "192.168.1.1/32", "::1/128", "fd00::/8"}
+	if len(a.nets) != len(want) {
+		t.Fatalf("nets = %v, want %v", a.nets, want)
+	}
+	for i, n := range a.nets {
+		if n.String() != want[i] {
+			t.Errorf("nets[%d] = %v, want %v", i, n, want[i])
+		}
+	}
+
+	for _, e := range []*entry{
+		{Allow: strPtr("10.0.0.0/33")},
+		{Allow: strPtr("example.com")},
+		{BasicAuth: []string{"nopassword"}},
+	} {
+		if a, err := newAccess(e); err == nil {
+			t.Errorf("newAccess(%+v) = %+v, want error", e, a)
+		}
+	}
+}
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func TestAccessAllowed(t *testing.T) {
+	a := newTestAccess(t, "10.0.0.0/8 ::1", []string{"ci:secret"}, []string{"token"})
+	tests := []struct {
+		name   string
+		remote string
+		auth   func(r *http.Request)
+		want   bool
+	}{
+		{"network", "10.1.2.3:1234", nil, true},
+		{"ipv6", "[::1]:1234", nil, true},
+		{"outside", "192.0.2.1:1234", nil, false},
+		{"basic", "192.0.2.1:1234", func(r *http.Request) { r.SetBasicAuth("ci", "secret") }, true},
+		{"wrong password", "192.0.2.1:1234", func(r *http.Request) { r.SetBasicAuth("ci", "guess") }, false},
+		{"bearer", "192.0.2.1:1234", func(r *http.Request) { r.Header.Set("Authorization", "Bearer token") }, true},
+		{"wrong token", "192.0.2.1:1234", func(r *http.Request) { r.Header.Set("Authorization", "Bearer other") }, false},
+		{"password as token", "192.0.2.1:1234", func(r *http.Request) { r.Header.Set("Authorization", "Bearer ci:secret") }, false},
+		{"token as password", "192.0.2.1:1234", func(r *http.Request) { r.SetBasicAuth("token", "") }, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remote
+		if tt.auth != nil {
+			tt.auth(r)
+		}
+		if got := a.allowed(r); got != tt.want {
+			t.Errorf("%s: allowed = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	var none *access
+	if !none.allowed(httptest.NewRequest("GET", "/", nil)) {
+		t.Errorf("nil access denies request")
+	}
+}
+
+func TestSiteServeAccess(t *testing.T) {
+	page := func(imprt string, a *access) rendered {
+		return rendered{
+			imprt:  imprt,
+			data:   []byte("page"),
+			goget:  []byte("goget"),
+			badge:  []byte("{}"),
+			browse: "https://github.com/example/x/{kind}/{path}",
+			access: a,
+		}
+	}
+	s := &site{
+		pages: map[string]rendered{
+			"example.com/pub":   page("example.com/pub", nil),
+			"example.com/creds": page("example.com/creds", newTestAccess(t, "", nil, []string{"token"})),
+			"example.com/net":   page("example.com/net", newTestAccess(t, "10.0.0.0/8", nil, nil)),
+		},
+		hosts: map[string]bool{"example.com": true},
+		host:  "example.com",
+	}
+	tests := []struct {
+		target string
+		token  bool
+		code   int
+		denied bool
+	}{
+		{"/pub?go-get=1", false, http.StatusOK, false},
+		{"/creds?go-get=1", false, http.StatusUnauthorized, true},
+		{"/creds?go-get=1", true, http.StatusOK, false},
+		{"/creds/sub/pkg?go-get=1", false, http.StatusUnauthorized, true},
+		{"/creds/sub/pkg?go-get=1", true, http.StatusOK, false},
+		{"/creds", false, http.StatusUnauthorized, true},
+		{"/creds/badge.json", false, http.StatusUnauthorized, true},
+		{"/creds/badge.json", true, http.StatusOK, false},
+		{"/creds/tree/master/x", false, http.StatusUnauthorized, true},
+		{"/creds/tree/master/x", true, http.StatusFound, false},
+		{"/net?go-get=1", false, http.StatusNotFound, true},
+		{"/net?go-get=1", true, http.StatusNotFound, true},
+		{"/net/sub?go-get=1", false, http.StatusNotFound, true},
+		{"/net/badge.json", false, http.StatusNotFound, true},
+		{"/net/blob/master/x.go", false, http.StatusNotFound, true},
+		{"/unknown?go-get=1", false, http.StatusNotFound, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "http://example.com"+tt.target, nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		if tt.token {
+			r.Header.Set("Authorization", "Bearer token")
+		}
+		w := httptest.NewRecorder()
+		_, denied := s.serve(w, r, r.FormValue("go-get") == "1")
+		if w.Code != tt.code || denied != tt.denied {
+			t.Errorf("%s (token %v): status %d, denied %v, want %d, %v", tt.target, tt.token, w.Code, denied, tt.code, tt.denied)
+		}
+		if tt.code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("%s: WWW-Authenticate = %q, want Bearer", tt.target, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+
+	// A client inside the network gets the restricted page.
+	r := httptest.NewRequest("GET", "http://example.com/net?go-get=1", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	w := httptest.NewRecorder()
+	if s.serve(w, r, true); w.Code != http.StatusOK {
+		t.Errorf("/net?go-get=1 from 10.0.0.1: status %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestAccessDeny(t *testing.T) {
+	tests := []struct {
+		a    *access
+		code int
+		auth string
+	}{
+		{newTestAccess(t, "", []string{"ci:secret"}, []string{"token"}), http.StatusUnauthorized, `Basic realm="govanity"`},
+		{newTestAccess(t, "", nil, []string{"token"}), http.StatusUnauthorized, "Bearer"},
+		{newTestAccess(t, "10.0.0.0/8", nil, nil), http.StatusNotFound, ""},
+	}
+	for i, tt := range tests {
+		w := httptest.NewRecorder()
+		tt.a.deny(w, httptest.NewRequest("GET", "/", nil))
+		if w.Code != tt.code || w.Header().Get("WWW-Authenticate") != tt.auth {
+			t.Errorf("%d: status %d, WWW-Authenticate %q, want %d, %q", i, w.Code, w.Header().Get("WWW-Authenticate"), tt.code, tt.auth)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// archiveFormat returns the format of the archive the output is written
+// to with -o: tar, tgz or zip, or the empty string for a directory.
+func archiveFormat() string {
+	switch {
+	case *outdir == "-" || strings.HasSuffix(*outdir, ".tar"):
+		return "tar"
+	case strings.HasSuffix(*outdir, ".tar.gz") || strings.HasSuffix(*outdir, ".tgz"):
+		return "tgz"
+	case strings.HasSuffix(*outdir, ".zip"):
+		return "zip"
+	}
+	return ""
+}
+
+// archived maps the names of the generated files to their contents
+// if the output is an archive.  It is protected by mu.
+var archived = map[string][]byte{}
+
+// writeArchive writes the generated files to the archive given with -o,
+// or to the standard output for ``-''.  The files are sorted by name and
+// have a fixed modification time, so that the archive only depends on
+// their contents.
+func writeArchive() (err error) {
+	var w io.Writer = os.Stdout
+	if *outdir != "-" {
+		f, err := os.Create(*outdir)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}()
+		w = f
+	}
+
+	names := make([]string, 0, len(archived))
+	for name := range archived {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	switch archiveFormat() {
+	case "zip":
+		// The modification time of zip files starts in 1980.
+		mtime := time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+		zw := zip.NewWriter(w)
+		for _, name := range names {
+			fw, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: mtime})
+			if err != nil {
+				return err
+			}
+			if _, err := fw.Write(archived[name]); err != nil {
+				return err
+			}
+		}
+		err = zw.Close()
+	case "tgz":
+		gw := gzip.NewWriter(w)
+		if err := writeTar(gw, names); err != nil {
+			return err
+		}
+		err = gw.Close()
+	default:
+		err = writeTar(w, names)
+	}
+	if err == nil && *outdir != "-" {
+		logEvent(fileEvent{"created", *outdir})
+	}
+	return err
+}
+
+// writeTar writes the archived files names as a tar archive to w.
+func writeTar(w io.Writer, names []string) error {
+	tw := tar.NewWriter(w)
+	for _, name := range names {
+		data := archived[name]
+		hdr := &tar.Header{
+			Name:    name,
+			Mode:    0644,
+			Size:    int64(len(data)),
+			ModTime: time.Unix(0, 0),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// latestVersion returns the latest semantic version tagged in the
+// repository repo, or the empty string if there is none.  Only git
+// repositories are supported.
+func latestVersion(vcs, repo string) (string, error) {
+	if vcs != "git" {
+		return "", nil
+	}
+	cmd := exec.Command("git", "ls-remote", "--tags", "--refs", "--", repo)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git ls-remote %s: %v", repo, err)
+	}
+	latest := ""
+	for _, line := range strings.Split(string(out), "\n") {
+		f := strings.Fields(line)
+		if len(f) != 2 {
+			continue
+		}
+		tag := strings.TrimPrefix(f[1], "refs/tags/")
+		if parseSemver(tag) != nil && (latest == "" || semverLess(latest, tag)) {
+			latest = tag
+		}
+	}
+	return latest, nil
+}
+
+// parseSemver returns the major, minor and patch version and the
+// prerelease of the semantic version v, or nil if v is not one.
+func parseSemver(v string) []string {
+	if !strings.HasPrefix(v, "v") {
+		return nil
+	}
+	v = v[1:]
+	if i := strings.IndexByte(v, '+'); i >= 0 {
+		v = v[:i]
+	}
+	pre := ""
+	if i := strings.IndexByte(v, '-'); i >= 0 {
+		v, pre = v[:i], v[i+1:]
+	}
+	f := strings.Split(v, ".")
+	if len(f) != 3 {
+		return nil
+	}
+	for _, n := range f {
+		if _, err := strconv.Atoi(n); err != nil {
+			return nil
+		}
+	}
+	return append(f, pre)
+}
+
+// semverLess reports whether the semantic version v is lower than w.
+// Prerelease versions are lower than the release and compared as strings.
+func semverLess(v, w string) bool {
+	a, b := parseSemver(v), parseSemver(w)
+	for i := 0; i < 3; i++ {
+		x, _ := strconv.Atoi(a[i])
+		y, _ := strconv.Atoi(b[i])
+		if x != y {
+			return x < y
+		}
+	}
+	switch {
+	case a[3] == b[3]:
+		return false
+	case a[3] == "":
+		return false
+	case b[3] == "":
+		return true
+	}
+	return a[3] < b[3]
+}
+
+// badgeName returns the file name of the badge of p,
+// relative to the output directory.
+func (p page) badgeName() string {
+	return path.Join(p.path(), "badge.json")
+}
+
+// renderBadge returns the shields.io endpoint badge of p, which shows
+// the import path and the latest version.
+func renderBadge(p page) ([]byte, error) {
+	b := struct {
+		SchemaVersion int    `json:"schemaVersion"`
+		Label         string `json:"label"`
+		Message       string `json:"message"`
+		Color         string `json:"color"`
+	}{1, p.dir, p.e.version, "blue"}
+	if b.Message == "" {
+		b.Message = "no release"
+		b.Color = "lightgrey"
+	}
+	data, err := json.Marshal(b)
+	return append(data, '\n'), err
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSemver(t *testing.T) {
+	tests := []struct {
+		v    string
+		want []string
+	}{
+		{"v1.2.3", []string{"1", "2", "3", ""}},
+		{"v0.10.0-rc.1", []string{"0", "10", "0", "rc.1"}},
+		{"v1.2.3+build.5", []string{"1", "2", "3", ""}},
+		{"v1.2.3-beta+build", []string{"1", "2", "3", "beta"}},
+		{"1.2.3", nil},
+		{"v1.2", nil},
+		{"v1.2.3.4", nil},
+		{"v1.x.3", nil},
+		{"v1.+2.3", nil},
+		{"v1..3", nil},
+		{"master", nil},
+	}
+	for _, tt := range tests {
+		if got := parseSemver(tt.v); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseSemver(%q) = %q, want %q", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestSemverLess(t *testing.T) {
+	tests := []struct {
+		v, w string
+		want bool
+	}{
+		{"v1.2.3", "v1.2.4", true},
+		{"v1.2.4", "v1.2.3", false},
+		{"v1.9.0", "v1.10.0", true},
+		{"v2.0.0", "v10.0.0", true},
+		{"v1.0.0-rc.1", "v1.0.0", true},
+		{"v1.0.0", "v1.0.0-rc.1", false},
+		{"v1.0.0-alpha", "v1.0.0-beta", true},
+		{"v1.0.0", "v1.0.0", false},
+	}
+	for _, tt := range tests {
+		if got := semverLess(tt.v, tt.w); got != tt.want {
+			t.Errorf("semverLess(%q, %q) = %v, want %v", tt.v, tt.w, got, tt.want)
+		}
+	}
+}
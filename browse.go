@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/url"
+	"strings"
+)
+
+// browseHosts are the URL templates for browsing the repositories
+// of the known hosts.
+var browseHosts = map[string]string{
+	"bitbucket.org": "{repo}/src/{path}",
+	"github.com":    "{repo}/{kind}/{path}",
+	"gitlab.com":    "{repo}/-/{kind}/{path}",
+}
+
+// browseTemplate returns the URL template for browsing the repository
+// of e, with {repo} already replaced: the ``browse-url'' entry, or the
+// template of the repository host.
+func browseTemplate(e *entry) (string, error) {
+	repo := strings.TrimSuffix(*e.Repo, ".git")
+	t := ""
+	if e.BrowseURL != nil && *e.BrowseURL != "" {
+		t = *e.BrowseURL
+	} else {
+		u, err := url.Parse(repo)
+		if err != nil {
+			return "", err
+		}
+		var ok bool
+		t, ok = browseHosts[u.Hostname()]
+		if !ok {
+			return "", fmt.Errorf("no URL template for host %q, set browse-url", u.Hostname())
+		}
+	}
+	return strings.Replace(t, "{repo}", repo, -1), nil
+}
+
+// browseURL returns the URL for browsing the path rest (a revision
+// followed by a path in the repository) with the template t.  kind
+// is tree for directories and blob for files.
+func browseURL(t, kind, rest string) string {
+	return strings.NewReplacer("{kind}", kind, "{path}", rest).Replace(t)
+}
+
+// splitBrowse splits the path p of a browsing request, like
+// ``cmd/govanity/tree/master/serve.go'', at every ``tree'' or ``blob''
+// element, and calls f with the path before it, the kind and the path
+// after it, until f returns true.
+func splitBrowse(p string, f func(prefix, kind, rest string) bool) {
+	elems := strings.Split(p, "/")
+	for i := len(elems) - 2; i >= 0; i-- {
+		if elems[i] != "tree" && elems[i] != "blob" {
+			continue
+		}
+		if f(strings.Join(elems[:i], "/"), elems[i], strings.Join(elems[i+1:], "/")) {
+			return
+		}
+	}
+}
+
+// tmpl404 is the not found page for static sites, which redirects
+// browsing requests to the repository hosts.
+var tmpl404 = template.Must(template.New("404").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Not found</title>
+<script>
+var routes = {{.}};
+var elems = location.pathname.replace(/^\/+|\/+$/g, "").split("/");
+for (var i = elems.length - 2; i >= 0; i--) {
+	if (elems[i] !== "tree" && elems[i] !== "blob") {
+		continue;
+	}
+	var t = routes[elems.slice(0, i).join("/")];
+	if (t) {
+		location.replace(t.split("{kind}").join(elems[i]).split("{path}").join(elems.slice(i + 1).join("/")));
+		break;
+	}
+}
+</script>
+</head>
+<body>
+Not found.
+</body>
+</html>
+`))
+
+// write404 writes a 404.html file redirecting the browsing requests
+// for the pages with ``browse'' set, if there are any.
+func write404(pages []page) error {
+	routes := make(map[string]string)
+	for _, p := range pages {
+		if p.e.browse != "" {
+			routes[p.path()] = p.e.browse
+		}
+	}
+	if len(routes) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(routes)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	err = tmpl404.Execute(&buf, template.JS(data))
+	if err != nil {
+		return err
+	}
+	ev, err := writeFile("404.html", buf.Bytes())
+	logEvent(ev)
+	return err
+}
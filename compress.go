@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// encodings maps the extensions of the precompressed files written
+// with -compress to their content encodings.
+var encodings = map[string]string{
+	".gz": "gzip",
+	".br": "br",
+}
+
+// contents maps the names of the generated files to their contents
+// with -compress.  It is protected by mu.
+var contents = map[string][]byte{}
+
+// compressible reports whether the file name gets precompressed variants.
+func compressible(name string) bool {
+	switch path.Ext(name) {
+	case ".html", ".json", ".xml", ".txt":
+		return true
+	}
+	return false
+}
+
+// compressFiles writes the files ``name.gz'' and ``name.br'' next to
+// every generated file name with compressible contents.  The contents of
+// the cached pages, which were not written in this run, are read from the
+// output directory.
+func compressFiles() error {
+	var names []string
+	for name := range written {
+		if compressible(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	events := make([][]fileEvent, len(names))
+	errs := make([]error, len(names))
+	parallel(len(names), func(i int) {
+		name := names[i]
+		mu.Lock()
+		data, ok := contents[name]
+		if !ok {
+			data, ok = archived[name]
+		}
+		mu.Unlock()
+		if !ok {
+			data, errs[i] = ioutil.ReadFile(outFile(name))
+		}
+		for _, ext := range []string{".gz", ".br"} {
+			if errs[i] != nil {
+				return
+			}
+			var z []byte
+			z, errs[i] = compressData(ext, data)
+			if errs[i] == nil {
+				var ev fileEvent
+				ev, errs[i] = writeFile(name+ext, z)
+				events[i] = append(events[i], ev)
+			}
+		}
+	})
+	for i, evs := range events {
+		for _, ev := range evs {
+			logEvent(ev)
+		}
+		if errs[i] != nil {
+			return errs[i]
+		}
+	}
+	return nil
+}
+
+// compressData compresses data with the encoding of the extension ext,
+// at the highest level.  The gzip header has no name and modification
+// time, so that the result only depends on data.
+func compressData(ext string, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	if ext == ".gz" {
+		zw, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+		if err != nil {
+			return nil, err
+		}
+		w = zw
+	} else {
+		w = brotli.NewWriterLevel(&buf, brotli.BestCompression)
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	err := w.Close()
+	return buf.Bytes(), err
+}
+
+// uncompressedName returns the name of the file name was compressed from,
+// and its content encoding, or name itself if it is not compressed.
+func uncompressedName(name string) (string, string) {
+	if enc, ok := encodings[path.Ext(name)]; ok {
+		return strings.TrimSuffix(name, path.Ext(name)), enc
+	}
+	return name, ""
+}
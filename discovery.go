@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// A metaImport is the content of a go-import meta tag.
+type metaImport struct {
+	Prefix, VCS, RepoRoot string
+}
+
+// parseMetaGoImports returns the go-import meta tags in the head of
+// the HTML document r, like the go tool does.
+func parseMetaGoImports(r io.Reader) ([]metaImport, error) {
+	d := xml.NewDecoder(r)
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+	var imports []metaImport
+	for {
+		t, err := d.RawToken()
+		if err != nil {
+			if err != io.EOF && len(imports) == 0 {
+				return nil, err
+			}
+			break
+		}
+		if e, ok := t.(xml.StartElement); ok && strings.EqualFold(e.Name.Local, "body") {
+			break
+		}
+		if e, ok := t.(xml.EndElement); ok && strings.EqualFold(e.Name.Local, "head") {
+			break
+		}
+		e, ok := t.(xml.StartElement)
+		if !ok || !strings.EqualFold(e.Name.Local, "meta") {
+			continue
+		}
+		if attrValue(e.Attr, "name") != "go-import" {
+			continue
+		}
+		if f := strings.Fields(attrValue(e.Attr, "content")); len(f) == 3 {
+			imports = append(imports, metaImport{f[0], f[1], f[2]})
+		}
+	}
+	return imports, nil
+}
+
+// attrValue returns the value of the attribute name in attrs.
+func attrValue(attrs []xml.Attr, name string) string {
+	for _, a := range attrs {
+		if strings.EqualFold(a.Name.Local, name) {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// matchGoImport returns the meta tag in imports whose prefix
+// matches the import path imprt.
+func matchGoImport(imports []metaImport, imprt string) (metaImport, error) {
+	var match *metaImport
+	for i, mi := range imports {
+		if mi.Prefix != imprt && !strings.HasPrefix(imprt, mi.Prefix+"/") {
+			continue
+		}
+		if match != nil {
+			return metaImport{}, fmt.Errorf("multiple meta tags match import path %q", imprt)
+		}
+		match = &imports[i]
+	}
+	if match == nil {
+		return metaImport{}, fmt.Errorf("no meta tag matches import path %q", imprt)
+	}
+	return *match, nil
+}
+
+// modulePath returns the module path declared in the go.mod file data,
+// or the empty string if there is none.
+func modulePath(data []byte) string {
+	for _, line := range strings.Split(string(data), "\n") {
+		f := strings.Fields(line)
+		if len(f) < 2 || f[0] != "module" {
+			continue
+		}
+		if p, err := strconv.Unquote(f[1]); err == nil {
+			return p
+		}
+		return f[1]
+	}
+	return ""
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+)
+
+// The exit codes of govanity.
+const (
+	exitFailed  = 1 // some imports or files failed
+	exitConfig  = 2 // invalid flags or configuration
+	exitChanged = 3 // with -diff: files would change
+)
+
+// A fileEvent reports what happened to a file.
+type fileEvent struct {
+	Event string `json:"event"` // created, updated, skipped, deleted or uploaded
+	File  string `json:"file"`
+}
+
+// verbs are the text forms of the events.
+var verbs = map[string]string{
+	"created":  "creating",
+	"updated":  "updating",
+	"deleted":  "deleting",
+	"uploaded": "uploading",
+}
+
+// changed is set when a file was or, with -diff, would be changed.
+var changed bool
+
+// logEvent reports ev: as a JSON object with -log json, or as text with
+// -v or -diff, where skipped files are left out.  Events without a kind
+// are ignored.
+func logEvent(ev fileEvent) {
+	if ev.Event == "" {
+		return
+	}
+	if ev.Event != "skipped" {
+		changed = true
+	}
+	switch {
+	case *quiet:
+	case *logFormat == "json":
+		data, err := json.Marshal(ev)
+		ck(err)
+		fmt.Printf("%s\n", data)
+	case (*verbose || *diff) && ev.Event != "skipped":
+		fmt.Printf("%s %s\n", verbs[ev.Event], ev.File)
+	}
+}
+
+// warnf logs a warning unless -q is given.
+func warnf(format string, args ...interface{}) {
+	if !*quiet {
+		log.Printf(format, args...)
+	}
+}
+
+// ckConfig exits with exitConfig if err, an error in the flags
+// or the configuration, is not nil.
+func ckConfig(err error) {
+	if err != nil {
+		log.Print(err)
+		os.Exit(exitConfig)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// funcs are the functions available in template expressions.
+var funcs = template.FuncMap{
+	"lower":      strings.ToLower,
+	"upper":      strings.ToUpper,
+	"base":       path.Base,
+	"dir":        path.Dir,
+	"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+	"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+	"replace":    func(old, new, s string) string { return strings.Replace(s, old, new, -1) },
+	"split":      func(sep, s string) []string { return strings.Split(s, sep) },
+	"regexReplace": func(expr, repl, s string) (string, error) {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return "", err
+		}
+		return re.ReplaceAllString(s, repl), nil
+	},
+	"regexFind": func(expr, s string) ([]string, error) {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		m := re.FindStringSubmatch(s)
+		if m == nil {
+			return nil, fmt.Errorf("%q does not match %q", s, expr)
+		}
+		return m, nil
+	},
+}
+
+// parseExpr parses the template expressions in s.
+func parseExpr(s string) (*template.Template, error) {
+	return template.New("").Funcs(funcs).Option("missingkey=error").Parse(s)
+}
+
+// expandExpr executes the template expressions in s and replaces the
+// placeholders in the text around them, but not in their results.
+// imprt is the full import path, k the import path without the root domain.
+func expandExpr(s, imprt, k, root string) (string, error) {
+	if !strings.Contains(s, "{{") {
+		return expand(s, imprt, k, root)
+	}
+	t, err := parseExpr(s)
+	if err != nil {
+		return "", err
+	}
+	var errs []error
+	var walk func(n parse.Node)
+	walk = func(n parse.Node) {
+		switch n := n.(type) {
+		case *parse.ListNode:
+			if n == nil {
+				return
+			}
+			for _, n := range n.Nodes {
+				walk(n)
+			}
+		case *parse.TextNode:
+			text, err := expand(string(n.Text), imprt, k, root)
+			errs = append(errs, err)
+			n.Text = []byte(text)
+		case *parse.IfNode:
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.RangeNode:
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.WithNode:
+			walk(n.List)
+			walk(n.ElseList)
+		}
+	}
+	walk(t.Tree.Root)
+	for _, err := range errs {
+		if err != nil {
+			return "", err
+		}
+	}
+
+	var sb strings.Builder
+	err = t.Execute(&sb, struct {
+		Import string // full import path
+		Path   string // import path without the root
+		Root   string
+		Name   string // last element of the import path
+	}{imprt, k, root, path.Base(k)})
+	return sb.String(), err
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+)
+
+// pagesConfig is the [pages] section, which selects the auxiliary
+// files for GitHub Pages.
+type pagesConfig struct {
+	CNAME    bool
+	Nojekyll bool
+	Robots   bool
+	Sitemap  bool
+}
+
+// robots is the content of the generated robots.txt.
+const robots = `User-agent: *
+Disallow:
+`
+
+// writePagesFiles writes the auxiliary files selected in the [pages]
+// section of cfg for the generated pages.
+func writePagesFiles(cfg *config, pages []page) error {
+	type file struct {
+		name string
+		data string
+	}
+	var files []file
+	if cfg.Pages.CNAME {
+		if cfg.Default.Root == nil || *cfg.Default.Root == "" {
+			return errors.New("pages: cname requires a root in the default section")
+		}
+		files = append(files, file{"CNAME", *cfg.Default.Root + "\n"})
+	}
+	if cfg.Pages.Nojekyll {
+		files = append(files, file{".nojekyll", ""})
+	}
+	if cfg.Pages.Robots {
+		data := robots
+		if cfg.Pages.Sitemap && cfg.Default.Root != nil && *cfg.Default.Root != "" {
+			data += "Sitemap: https://" + *cfg.Default.Root + "/sitemap.xml\n"
+		}
+		files = append(files, file{"robots.txt", data})
+	}
+	if cfg.Pages.Sitemap {
+		data, err := sitemap(pages)
+		if err != nil {
+			return err
+		}
+		files = append(files, file{"sitemap.xml", data})
+	}
+
+	for _, f := range files {
+		ev, err := writeFile(f.name, []byte(f.data))
+		if err != nil {
+			return err
+		}
+		logEvent(ev)
+	}
+	return nil
+}
+
+// sitemap returns a sitemap.xml listing the URLs of pages.
+func sitemap(pages []page) (string, error) {
+	type url struct {
+		Loc string `xml:"loc"`
+	}
+	m := struct {
+		XMLName xml.Name `xml:"urlset"`
+		Xmlns   string   `xml:"xmlns,attr"`
+		URLs    []url    `xml:"url"`
+	}{Xmlns: "http://www.sitemaps.org/schemas/sitemap/0.9"}
+	for _, p := range pages {
+		m.URLs = append(m.URLs, url{p.url()})
+	}
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	enc := xml.NewEncoder(&b)
+	enc.Indent("", "\t")
+	if err := enc.Encode(m); err != nil {
+		return "", err
+	}
+	b.WriteString("\n")
+	return b.String(), nil
+}
@@ -2,42 +2,409 @@
 // These files can then be served e.g. on Github Pages.
 // It loads a configuration file (default ``govanity.cfg''), which defines the import
 // paths and their corresponding VCS repositories.
+// The -c flag can be given multiple times; the files are then read in order,
+// with later files adding imports and overriding the entries of earlier ones.
+// A directory stands for the ``*.cfg'' files it contains, in sorted order,
+// and ``-'' for the standard input.
 //
 // Usage:
 //
-//	govanity [-c cfg] [-o outdir] [-v]
+//	govanity [-c cfg ...] [-o outdir] [-manifest file] [-json file] [-j jobs] [-http addr]
+//	         [-https addr] [-certcache dir] [-metrics addr] [-accesslog file]
+//	         [-publish url]
+//	         [-layout full|strip-root] [-gopath list] [-srcdir [import=]dir ...]
+//	         [-force] [-prune] [-diff] [-compress] [-v] [-q]
+//	         [-log text|json] [command [args]]
+//
+// The commands are:
+//
+//	import dir|url  convert an existing vanity site into a configuration
+//	list [-json]    print the resolved mappings
+//	preview [-addr addr] [import ...]
+//	                serve the output directory and resolve the imports
+//	selftest [-go cmd] [import ...]
+//	                download the imports with the go command
+//	verify          check the generated pages
+//	vet             check the configuration
 //
 // The config has the following layout:
 //
 //	[default]
+//		profile = <name>                # default: none
 //		root = <root domain>
 //		repo = <url to repository>
-//		vcs = <vcs>                     # default: git
+//		vcs = <vcs>                     # default: guessed from repo
 //		redirect = <url redirection>    # default: https://godoc.org/*
+//		noredirect-template = <file>    # default: none
 //		dirs = true | false		# default: true
+//		exclude = <patterns>            # default: none
+//		nested = follow | skip          # default: follow
+//		browse = true | false           # default: false
+//		filename = index | html | both  # default: index
+//		allow = <networks>              # default: none
+//		basic-auth = <user>:<password>  # can be repeated
+//		bearer-token = <token>          # can be repeated
+//		browse-url = <url template>     # default: by the repository host
+//		landing = true | false          # default: false
+//		ref = <branch or tag>           # default: none
+//		badge = true | false            # default: false
+//		delay = <seconds>               # default: 0
+//		cache-control = <header>        # default: public, max-age=300
+//		etag = true | false             # default: true
+//		meta = <name> <content>         # can be repeated
+//		head = <html>                   # can be repeated
 //
 //	[import "path"]
+//		profile = ...
 //		root = ...
 //		repo = ...
 //		vcs = ...
 //		redirect = ...
+//		noredirect-template = ...
 //		dirs = ...
+//		exclude = ...
+//		nested = ...
+//		browse = ...
+//		filename = ...
+//		allow = ...
+//		basic-auth = ...
+//		bearer-token = ...
+//		browse-url = ...
+//		landing = ...
+//		ref = ...
+//		badge = ...
+//		delay = ...
+//		cache-control = ...
+//		etag = ...
+//		meta = ...
+//		head = ...
 //	[import "another/path"]
 //
+//	[profile "name"]
+//		root = ...
+//		...
+//
+//	[pages]
+//		cname = true | false            # default: false
+//		nojekyll = true | false         # default: false
+//		robots = true | false           # default: false
+//		sitemap = true | false          # default: false
+//
+//	[workspace]
+//		dir = <directory>               # can be repeated
+//
 // If the entries for an import section are not defined, they are taken from
-// the default section.  The ``repo'' and ``redirect'' entries can contain the special
+// the profile section named by its ``profile'' entry, if any, and then from the
+// default section.  A profile section has the same entries as an import section,
+// except for ``profile'', so that groups of imports, e.g. those hosted on GitHub
+// and those on an internal GitLab, can share their repository and redirection:
+//
+//	[default]
+//		root = rtrn.io
+//	[profile "internal"]
+//		repo = https://gitlab.example.com/go/$
+//		redirect = https://docs.example.com/*
+//		allow = 10.0.0.0/8
+//	[import "internal/auth"]
+//		profile = internal
+//
+// The ``meta'' and ``head'' entries of the profile come after those of the default
+// section and before those of the import.
+//
+// The ``repo'' and ``redirect'' entries can contain the special
 // characters ``*'' and ``$''.  ``*'' is replaced by the full import path (including the
 // root domain), while ``$'' is replaced by the last part of the import path.
+// Further placeholders are ``%i'' (the import path without the root domain),
+// ``%r'' (the root domain), ``%b'' (the same as ``$'') and ``${NAME}'', which is
+// replaced by the environment variable NAME; it is an error if NAME is not set.
+// ``**'', ``$$'' and ``%%'' stand for a literal ``*'', ``$'' and ``%'' respectively.
+// Note that lowercase percent-escapes in URLs, like ``%bf'' in ``%e4%b8%ad'', start
+// with the ``%b'' placeholder, so they must be written as ``%%bf''; vet reports them.
+//
+// For more involved transformations, the same entries can contain expressions in the
+// syntax of text/template, which are evaluated before the placeholders; the placeholders
+// are not replaced in their results.  The expressions can use .Import (the full import
+// path), .Path (the import path without the root domain), .Root and .Name (the last
+// part of the import path), and the functions lower, upper, base, dir, trimPrefix,
+// trimSuffix, replace, split, regexReplace and regexFind, which returns the match
+// and its capture groups.  The string argument comes last, so they can be chained.
+// The configuration removes the double quotes of values, so string constants are
+// written as raw strings in backquotes:
+//
+//	repo = https://github.com/org/{{.Path | trimPrefix `tools/` | replace `-` ``}}
+//	redirect = https://example.com/{{index (regexFind `^tools/(.*)$` .Path) 1}}
+//
+// The ``vcs'' entry must be one of the version control systems supported by the
+// go tool: bzr, fossil, git, hg or svn, and ``repo'' must be a URL with a scheme
+// the go tool accepts for it, e.g. ``https'' or ``ssh''.  If ``vcs'' is not set,
+// it is guessed from ``repo'': a suffix like ``.hg'', a host serving only one
+// system like launchpad.net (bzr), or a host name like ``hg.example.com''
+// selects that system; otherwise git is used.
 //
 // The ``redirect'' entry specifies an URL, which the generated HTML files will redirect to.
 // By default, they will redirect to the corresponding godoc.org documentation.
-// No redirect will be created if ``redirect'' is empty or not defined.
+// No redirect will be created if ``redirect'' is ``none'' or empty, so an import can
+// turn off the redirection of the default section with ``redirect = none''.
+// The pages without redirection contain only the meta tags, unless
+// ``noredirect-template'' names a file with an html/template to render them
+// instead, relative to the configuration file.  It is executed with .Import,
+// .VCS and .Repo (the contents of the go-import meta tag), .Path (the import
+// path of the page), .Synopsis (of its package documentation), .Install (the
+// command to install it), .Docs (the URL of its documentation on pkg.go.dev),
+// and .Meta and .Head (the ``meta'' and ``head'' entries).  The template is not
+// used for landing pages and in the document for the go tool.  In serve mode,
+// the pages are rendered again when the template file changes.
 //
 // If ``dirs'' is true, govanity will walk the directories of the defined imports in your
 // GOPATH and also generate imports for all sub-directories that contain source files
-// with an import comment.
+// with an import comment, or that belong to a module.  The import path of a directory
+// in a module is derived from the module path in its go.mod file, so a nested module,
+// with a go.mod file of its own, changes the import paths of its directories.  With
+// ``nested = skip'', nested modules are skipped instead.  Directories whose import path
+// is not below the import are skipped as well, as are those belonging to another
+// configured import below it, whose own entries take precedence.
 // These will have the same entries as their parent, but their redirection URL will be
 // extended by the respective directory name.
+// The GOPATH can have several entries, separated like in $GOPATH, and can be
+// replaced with -gopath; the directory of an import is taken from the first entry
+// that has it.  Each -srcdir is searched before the GOPATH: either a directory
+// containing the imports by import path, like the src directory of a GOPATH, or
+// ``import=dir'' for a checkout of a single import anywhere, e.g.
+// ``-srcdir rtrn.io/cmd/govanity=.''.
+// If ``ref'' is set, the directories are not taken from the GOPATH, but from a
+// shallow clone of the branch or tag ``ref'' of the repository, which must be a
+// git repository.  This way, the pages match a specific release, independent of
+// the state of the GOPATH.
+// Directories named ``vendor'' and those ignored by the go tool (starting with
+// ``.'' or ``_'') are always skipped, as are the directories matching
+// one of the space-separated ``exclude'' patterns, e.g.
+//
+//	exclude = internal/* testdata third_party/**
+//
+// A pattern without a slash is matched against the directory name, at any depth;
+// otherwise it is matched against the path relative to the import, where ``**''
+// matches any number of path elements.  The sub-directories of an excluded
+// directory are skipped as well.
+//
+// If ``landing'' is true, the pages are landing pages for humans instead of
+// redirections: besides the meta tag, they show the synopsis of the package
+// documentation, the command to install it, a badge and links to the documentation
+// (the ``redirect'' URL, or pkg.go.dev if it is empty) and to the repository.
+//
+// If ``badge'' is true, a file ``badge.json'' is written next to each page,
+// which can be used with the shields.io endpoint badge, e.g.
+// https://img.shields.io/endpoint?url=https://rtrn.io/cmd/govanity/badge.json.
+// It shows the import path and the latest semantic version tagged in the
+// repository (git only).
+//
+// ``delay'' is the number of seconds before the pages redirect to the ``redirect''
+// URL.  Landing pages only redirect if a delay is set, so they can be shown for
+// a while before.  ``cache-control'' is the Cache-Control header of the pages
+// when they are served with -http or -https or uploaded with -publish.  In serve
+// mode, the pages also get an ETag header unless ``etag'' is false, so that
+// clients can revalidate them cheaply.
+//
+// If ``browse'' is true, paths below an import that contain a ``tree'' or ``blob''
+// element, like rtrn.io/cmd/govanity/blob/master/serve.go, are forwarded to the
+// corresponding page of the repository host.  The URL is built from the template
+// ``browse-url'', where ``{repo}'' is replaced by the repository URL, ``{kind}''
+// by tree or blob and ``{path}'' by the rest of the path; for repositories on
+// github.com, gitlab.com and bitbucket.org, the template is known.  In serve mode,
+// such requests are redirected.  Otherwise, govanity writes a 404.html file doing
+// the redirection with JavaScript, which GitHub Pages serves for all missing paths.
+//
+// Each ``meta'' entry adds a meta tag with the given name and content to the
+// head of the pages; names containing a colon, like ``og:title'', are written
+// as Open Graph properties; they can contain the same placeholders as ``repo''.
+// Each ``head'' entry is inserted verbatim into the head, without replacing any
+// placeholders, so that snippets like jQuery's ``$(...)'' work.  The entries of
+// the default section come before those of the import, e.g.
+//
+//	[default]
+//		meta = "theme-color #00add8"
+//	[import "cmd/govanity"]
+//		meta = og:title *
+//		head = "<link rel=\"icon\" href=\"/favicon.ico\">"
+//
+// The document served to the go tool in serve mode does not contain them.
+//
+// The -layout flag controls where the pages are written in the output directory.
+// With the default ``strip-root'', the first element of the import path is removed,
+// so the page for ``rtrn.io/cmd/govanity'' is written to ``cmd/govanity/index.html''.
+// With ``full'', the root domain of the import is removed instead, which keeps
+// the full import path for roots with more than one element and for imports
+// without a root.
+//
+// The ``filename'' entry selects the file names of the pages of an import:
+// ``index'' writes the page for ``rtrn.io/cmd/govanity'' to ``cmd/govanity/index.html'',
+// ``html'' to ``cmd/govanity.html'', for hosts serving it as ``/cmd/govanity''
+// without a trailing slash, and ``both'' to both files.  The URLs in the sitemap
+// and the requests of the verify and preview commands follow the file names.
+//
+// The optional ``pages'' section selects auxiliary files for GitHub Pages,
+// which are written to the output directory next to the import pages:
+// ``cname'' writes a CNAME file containing the root domain of the default section,
+// ``nojekyll'' an empty .nojekyll file, so that paths starting with an underscore
+// are published, ``robots'' a robots.txt allowing all crawlers, and ``sitemap''
+// a sitemap.xml listing the URLs of all generated pages, e.g.
+// https://rtrn.io/cmd/govanity/.  If both ``robots'' and ``sitemap'' are set and
+// the default section has a root, robots.txt points to the sitemap.
+//
+// The optional ``workspace'' section discovers imports from the modules in local
+// directories, e.g. ``dir = ~/src/work''.  Every go.mod file below them whose module
+// path starts with the root domain of the default section, and that is at the top of
+// a git repository, adds an import for the module path, with the URL of the remote
+// ``origin'' as repository; scp-like URLs such as git@github.com:rtrn/govanity.git
+// are converted to https.  The directories of these imports are walked in the
+// workspace instead of the GOPATH.  Imports defined in the configuration take
+// precedence over discovered ones.
+//
+// Imports are processed in sorted order, and the generated files only depend on
+// the configuration and the walked directories, so repeated runs produce
+// byte-for-byte identical output.  With -manifest, govanity additionally writes
+// the SHA-256 hashes of all generated files, relative to the output directory,
+// in the format of sha256sum(1), so the output can be verified with
+// ``sha256sum -c''.
+// With -compress, every generated HTML, JSON, XML and text file is additionally
+// written compressed with gzip and brotli, as ``index.html.gz'' and ``index.html.br''
+// next to ``index.html'', for hosts and CDNs serving precompressed files.  The
+// compressed files are included in the manifest, the state file and archives, and
+// are published with the content type of the original file and their encoding.
+// With -json, it writes a JSON array describing every generated page: its import
+// path, the import prefix and VCS and repository of its meta tag, the redirection
+// URL and the file name relative to the output directory.
+//
+// Govanity records the configuration and the generated files in the state file
+// ``.govanity-state'' in the output directory.  On the next run, imports whose
+// entries did not change are skipped entirely, neither walked nor generated again,
+// as long as their files are unchanged in the output directory.  Changes in the
+// walked directories are therefore not noticed; -force regenerates all imports.
+// With -prune, the files recorded in the state file that were not generated in
+// this run are deleted.
+//
+// If -o names a file ending in ``.tar'', ``.tar.gz'', ``.tgz'' or ``.zip'', the
+// generated files are written to an archive of that format instead of a directory,
+// and with ``-o -'', as a tar archive to the standard output.  The files in the
+// archive are sorted and have a fixed modification time.  There is no state file
+// in an archive, so every run generates all imports, and -prune and -publish are
+// not available.
+//
+// With -publish, the generated files are uploaded to object storage after they
+// are written: to Amazon S3 for ``s3://bucket/prefix'', Google Cloud Storage for
+// ``gs://bucket/prefix'' and Azure Blob Storage for ``az://account/container/prefix'',
+// using the aws, gsutil or azcopy command, which must be installed and authorized.
+// The files are uploaded with their content type and the ``cache-control''
+// header of their import, or of the default section for the auxiliary files.
+// Only the files that changed since they were last published, as recorded in
+// the state file, are uploaded; with -force, all of them.  With -prune, the
+// published files no longer generated are deleted.
+//
+// If an import fails, e.g. because its repository is not set or its directories
+// cannot be walked, the other imports are generated regardless, while the files
+// of the failed import are left as they are.  At the end, govanity prints a summary
+// of the failures and exits with status 1; -prune is skipped in this case, both
+// in the output directory and for -publish.
+//
+// The directory walks and the generation of the files are done in parallel,
+// running at most -j jobs at once (default: the number of CPUs).  Messages and
+// errors are still reported in the order of the imports.
+//
+// With -http, govanity does not write any files, but serves the pages itself.
+// Requests with ``?go-get=1'' are answered with a minimal document containing
+// only the meta tag, all other requests with the redirection or landing page.
+// Requests with ``?go-get=1'' for packages below an import are answered with
+// the document of the import.  The pages are looked up by the Host header and the
+// path of the request, so several domains can be served at once; if there is only
+// one domain, it answers the requests for any host.  The configuration is reloaded
+// on SIGHUP and whenever one of the configuration files changes; if it cannot be
+// loaded, the previous pages are served further.
+//
+// With -https, the pages are served over HTTPS, using certificates that are
+// obtained automatically from Let's Encrypt for the domains of the imports and
+// cached in the -certcache directory.  The certificates are requested via the
+// TLS-ALPN-01 challenge on the -https address, and via HTTP-01 if -http is set
+// as well.  All other requests to the -http address are then redirected to HTTPS.
+//
+// In serve mode, the pages of an import can be restricted to some clients with
+// ``allow'', a space-separated list of networks like ``10.0.0.0/8'' or addresses,
+// ``basic-auth'' and ``bearer-token''.  A request is answered if it comes from one
+// of the networks or has one of the credentials or tokens; otherwise it gets
+// 401 Unauthorized if credentials are configured, or 404 Not Found.  Restricted
+// pages are marked as private for caches.  The credentials and tokens are expanded
+// like ``repo'', so they can be taken from the environment with ``${NAME}'', and
+// ``*'', ``$'' and ``%'' must be doubled.  The restrictions have no effect on the
+// generated files.
+//
+// With -metrics, the server also listens on a separate address, so that no
+// import path is taken, and answers ``/healthz'' there as long as it is running,
+// ``/readyz'' once the pages are loaded and ``/metrics'' with Prometheus metrics:
+// the number of go-get requests, browser requests and requests denied by their
+// restrictions per import path, the number of requests for unknown paths,
+// and a histogram of the response latencies.  With -accesslog, every page request
+// is also logged as a JSON object, including the import path it was answered with
+// and the user agent.
+//
+// The list command prints the mappings of all imports and the discovered
+// sub-directories, after the defaults are applied and the placeholders replaced:
+// a table of import path, VCS, repository and redirection URL, or with -json,
+// the same JSON array as written by the -json flag.  Like the verify, preview and
+// selftest commands, it reports the imports that fail and goes on with the others;
+// list then exits with status 1.
+//
+// The verify command checks the pages in the output directory, as written by a
+// previous run, instead of writing them.  It serves them on a local port, resolves
+// every page like ``go get'' does and reports meta tags that do not match the
+// configuration.  For every import with a git repository, it also clones the
+// repository (at ``ref'', if set) and reports if its go.mod file declares a module
+// path other than the import path, which would make ``go get'' fail.
+// The exit status is 1 if any check or import failed.
+//
+// The preview command serves the output directory on -addr (default
+// ``localhost:8080''), so the pages can be looked at in a browser, and resolves
+// every generated page and the import paths given as arguments against it like
+// ``go get'' does: it requests the import path and its parents with ``?go-get=1''
+// and prints the version control system, repository and import prefix of the
+// matching meta tag, or why resolution failed.  It then serves until interrupted.
+//
+// The selftest command proves that the pages in the output directory work with
+// the go command: it downloads the latest version of every import, or of the
+// modules given as arguments, with ``go mod download'' (or the command given with
+// -go) in a temporary GOPATH, and reports the version or the error.  The go command
+// runs with GOPROXY=direct and an HTTP proxy that answers the requests for the
+// domains of the pages from the output directory, so they need not be published
+// yet; the domains are set in GOINSECURE, so that the go command accepts them
+// over http, and in GOPRIVATE.  All other connections, e.g. to the repositories,
+// are passed through.  The exit status is 1 if any download or import failed.
+//
+// The import command converts an existing vanity site into a configuration,
+// which is printed to standard output.  Its argument is either a directory
+// containing the HTML files of the site, or the URL of a live site, whose pages
+// are crawled by following the links on the same host.  Every go-import prefix
+// becomes an import section with the repository of the meta tag, the redirection
+// URL of its page (a refresh meta tag or, on a live site, an HTTP redirection) and
+// a go-source meta tag, if there is one.  The common root domain and redirection
+// URL go to the default section.  The pages of the packages below an import are
+// not copied; the import gets ``dirs = true'' instead, so they are generated from
+// its sources, and a warning is printed.
+//
+// The vet command checks the configuration files and reports unknown sections
+// and variables, empty roots, import paths with a leading or trailing slash,
+// sections defined twice in the same file (which would be merged silently),
+// placeholders in variables that do not support them, malformed ``${NAME}''
+// placeholders and profiles not defined in any of the files, with the file, line
+// and section of each problem.
+// The same checks are done before every other command, which fails if any of
+// them does.
+//
+// With -diff, govanity does not write any files, but prints the ones that would
+// be created, updated or, with -prune, deleted.  With -log json, every generated,
+// unchanged, deleted and uploaded file is reported as a JSON object on a line of
+// its own, like {"event":"updated","file":"cmd/govanity/index.html"}, with the
+// event created, updated, skipped, deleted or uploaded.  With -q, govanity prints
+// nothing but errors.
+//
+// The exit status is 0 on success, 1 if any import or file failed, 2 for invalid
+// flags or an invalid configuration, and 3 with -diff if any file would change.
 //
 // Example config:
 //
@@ -61,55 +428,314 @@
 package main // import "rtrn.io/cmd/govanity"
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"go/build"
+	"go/doc"
 	"html/template"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/exec"
 	"path"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"unicode"
 
 	"gopkg.in/gcfg.v1"
 )
 
 var (
-	cfgfile = flag.String("c", "govanity.cfg", "configuration file")
-	outdir  = flag.String("o", ".", "output directory")
-	verbose = flag.Bool("v", false, "print names of files as they are written")
+	outdir     = flag.String("o", ".", "output directory, or archive `file` ending in .tar, .tar.gz, .tgz or .zip (- for a tar archive on stdout)")
+	manifest   = flag.String("manifest", "", "write SHA-256 hashes of the generated files to `file`")
+	jsonfile   = flag.String("json", "", "write the generated mappings as JSON to `file`")
+	jobs       = flag.Int("j", runtime.NumCPU(), "number of `jobs` to run in parallel")
+	httpAddr   = flag.String("http", "", "serve the pages on `addr` instead of writing them")
+	httpsAddr  = flag.String("https", "", "serve the pages over HTTPS on `addr`, with certificates from Let's Encrypt")
+	certcache  = flag.String("certcache", "govanity-certs", "cache the certificates in `dir`")
+	adminAddr  = flag.String("metrics", "", "in serve mode, answer /healthz, /readyz and /metrics on `addr`")
+	accesslog  = flag.String("accesslog", "", "in serve mode, append JSON access logs to `file` (- for stdout)")
+	force      = flag.Bool("force", false, "regenerate all imports, even if they did not change")
+	pruneFlag  = flag.Bool("prune", false, "delete files generated by earlier runs that are no longer generated")
+	layout     = flag.String("layout", "strip-root", "output directory `layout`: full or strip-root")
+	publishURL = flag.String("publish", "", "upload the output to `url`: s3://bucket/prefix, gs://bucket/prefix or az://account/container/prefix")
+	verbose    = flag.Bool("v", false, "print names of files as they are written")
+	quiet      = flag.Bool("q", false, "print nothing but errors")
+	logFormat  = flag.String("log", "text", "`format` of the file events: text, or json for one JSON object per file")
+	diff       = flag.Bool("diff", false, "print the files that would change, without writing them; exit with status 3 if any would")
+	gopath     = flag.String("gopath", "", "look for the imports in the `list` of directories instead of $GOPATH")
+	compress   = flag.Bool("compress", false, "write gzip and brotli compressed copies of the generated files next to them")
 )
 
 type entry struct {
-	Root     *string
-	Repo     *string
-	VCS      *string
-	Redirect *string
-	Dirs     *bool
-	imprt    *string
+	Profile       *string
+	Root          *string
+	Repo          *string
+	VCS           *string
+	Redirect      *string
+	NoRedirect    *string `gcfg:"noredirect-template"`
+	Dirs          *bool
+	Exclude       *string
+	Nested        *string
+	Browse        *bool
+	Filename      *string
+	Allow         *string
+	BasicAuth     []string `gcfg:"basic-auth"`
+	BearerToken   []string `gcfg:"bearer-token"`
+	BrowseURL     *string  `gcfg:"browse-url"`
+	Landing       *bool
+	Ref           *string
+	Badge         *bool
+	Delay         *int
+	CacheControl  *string `gcfg:"cache-control"`
+	ETag          *bool
+	Meta          []string
+	Head          []string
+	imprt         *string
+	hash          string
+	version       string // latest version, for the badge
+	browse        string // URL template for browsing, if enabled
+	src           string // source directory found in the workspace
+	access        *access
+	noRedirect    *template.Template // template of pages without redirection
+	noRedirectSrc string             // source of noRedirect
 }
 
-var cfg struct {
-	Default entry
-	Import  map[string]*entry
+type config struct {
+	Default   entry
+	Import    map[string]*entry
+	Profile   map[string]*entry
+	Pages     pagesConfig
+	Workspace workspaceConfig
+	templates map[string]*template.Template // by file name
 }
 
 func main() {
 	log.SetPrefix("govanity: ")
 	log.SetFlags(0)
+	flag.Var(&cfgfiles, "c", "configuration `file` or directory, - for stdin; can be repeated (default govanity.cfg)")
+	flag.Var(&srcdirs, "srcdir", "look for the imports in `dir` before the GOPATH, or for a single import with import=dir; can be repeated")
 	flag.Usage = usage
 	flag.Parse()
+	if len(cfgfiles) == 0 {
+		cfgfiles = cfgFiles{"govanity.cfg"}
+	}
+	if *gopath != "" {
+		build.Default.GOPATH = *gopath
+	}
+	if *jobs < 1 {
+		*jobs = 1
+	}
 
-	if flag.NArg() != 0 {
+	if *layout != "full" && *layout != "strip-root" {
+		log.Printf("invalid layout %q", *layout)
+		usage()
+	}
+	if *logFormat != "text" && *logFormat != "json" {
+		log.Printf("invalid log format %q", *logFormat)
 		usage()
 	}
 
-	err := gcfg.ReadFileInto(&cfg, *cfgfile)
+	args := flag.Args()
+	switch {
+	case len(args) == 0 && (*httpAddr != "" || *httpsAddr != ""):
+		serve()
+	case len(args) == 0:
+		generate()
+	case args[0] == "verify":
+		cmdVerify(args[1:])
+	case args[0] == "list":
+		cmdList(args[1:])
+	case args[0] == "vet":
+		cmdVet(args[1:])
+	case args[0] == "import":
+		cmdImport(args[1:])
+	case args[0] == "preview":
+		cmdPreview(args[1:])
+	case args[0] == "selftest":
+		cmdSelftest(args[1:])
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: govanity [flags] [command [args]]")
+	fmt.Fprintln(os.Stderr, "commands: import dir|url, list [-json], preview [-addr addr] [import ...], selftest [-go cmd] [import ...], verify, vet")
+	flag.PrintDefaults()
+	os.Exit(exitConfig)
+}
+
+// generate writes the pages and the auxiliary files.
+func generate() {
+	arch := archiveFormat() != ""
+	if arch && (*pruneFlag || *publishURL != "" || *diff) {
+		ckConfig(errors.New("-prune, -publish and -diff require an output directory"))
+	}
+	if *diff && *publishURL != "" {
+		ckConfig(errors.New("-diff cannot be used with -publish"))
+	}
+	cfg, err := readConfig(cfgfiles)
+	ckConfig(err)
+	old := new(state)
+	if !arch {
+		old = readState()
+	}
+	st := old
+	if *force {
+		st = nil
+	}
+	pages, err := collect(cfg, st)
+	failed, partial := err.(entryErrors)
+	if !partial {
+		ck(err)
+	}
+	failed = append(failed, govanity(pages)...)
+	err = writePagesFiles(cfg, pages)
+	ck(err)
+	err = write404(pages)
+	ck(err)
+	if *compress {
+		err = compressFiles()
+		ck(err)
+	}
+	if *pruneFlag && failed != nil {
+		warnf("not pruning because of errors")
+	} else if *pruneFlag {
+		err = prune(old)
+		ck(err)
+	}
+	var perr error
+	if *publishURL != "" {
+		perr = publish(cfg, pages, old, *pruneFlag && failed == nil)
+	}
+	switch {
+	case *diff:
+	case arch:
+		err = writeArchive()
+	default:
+		err = writeState(cfg, pages, old, failed)
+	}
+	// The failures are reported first, so that they are not hidden
+	// by an error writing the state or publishing.
+	failed.report(len(cfg.Import))
 	ck(err)
-	if cfg.Default.VCS == nil {
-		s := "git"
-		cfg.Default.VCS = &s
+	ck(perr)
+	if *manifest != "" && !*diff {
+		writeManifest(*manifest)
+	}
+	if *jsonfile != "" && !*diff {
+		writeJSON(*jsonfile, pages)
+	}
+	if failed != nil {
+		os.Exit(exitFailed)
+	}
+	if *diff && changed {
+		os.Exit(exitChanged)
+	}
+}
+
+// cfgFiles are the configuration files given with -c.
+type cfgFiles []string
+
+var cfgfiles cfgFiles
+
+func (c *cfgFiles) String() string {
+	return strings.Join(*c, " ")
+}
+
+func (c *cfgFiles) Set(s string) error {
+	*c = append(*c, s)
+	return nil
+}
+
+// files returns the configuration files, with the directories replaced
+// by the *.cfg files they contain, in sorted order.
+func (c cfgFiles) files() ([]string, error) {
+	var files []string
+	for _, f := range c {
+		if f == "-" {
+			files = append(files, f)
+			continue
+		}
+		fi, err := os.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			files = append(files, f)
+			continue
+		}
+		m, err := filepath.Glob(filepath.Join(f, "*.cfg"))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(m)
+		files = append(files, m...)
+	}
+	return files, nil
+}
+
+var (
+	stdinOnce sync.Once
+	stdin     []byte // configuration read from standard input
+	stdinErr  error
+)
+
+// readStdin reads the standard input if it is one of the configuration
+// files.  It can only be read once, so it is kept for reloads.
+func readStdin(files []string) error {
+	for _, f := range files {
+		if f == "-" {
+			stdinOnce.Do(func() {
+				stdin, stdinErr = ioutil.ReadAll(os.Stdin)
+			})
+			return stdinErr
+		}
+	}
+	return nil
+}
+
+// readConfig reads the configuration files c and fills in the defaults.
+// The files are read in order into the same configuration, so later files
+// add imports and override the variables set by earlier ones.
+// The files are checked with vet first.
+func readConfig(c cfgFiles) (*config, error) {
+	files, err := c.files()
+	if err != nil {
+		return nil, err
+	}
+	err = readStdin(files)
+	if err != nil {
+		return nil, err
+	}
+	if errs := vetFiles(files); len(errs) > 0 {
+		return nil, vetErrors(errs)
+	}
+	cfg := new(config)
+	templates := make(map[*string]string)
+	for _, f := range files {
+		dir := "."
+		if f == "-" {
+			err = gcfg.ReadStringInto(cfg, string(stdin))
+			if err != nil {
+				err = fmt.Errorf("stdin: %v", err)
+			}
+		} else {
+			err = gcfg.ReadFileInto(cfg, f)
+			dir = filepath.Dir(f)
+		}
+		if err != nil {
+			return nil, err
+		}
+		templatePaths(cfg, dir, templates)
 	}
 	if cfg.Default.Redirect == nil {
 		s := "https://godoc.org/*"
@@ -119,93 +745,843 @@ func main() {
 		dirs := true
 		cfg.Default.Dirs = &dirs
 	}
-
-	govanity()
+	if cfg.Default.Landing == nil {
+		landing := false
+		cfg.Default.Landing = &landing
+	}
+	if cfg.Default.Badge == nil {
+		badge := false
+		cfg.Default.Badge = &badge
+	}
+	if cfg.Default.CacheControl == nil {
+		cc := "public, max-age=300"
+		cfg.Default.CacheControl = &cc
+	}
+	if cfg.Default.ETag == nil {
+		etag := true
+		cfg.Default.ETag = &etag
+	}
+	if cfg.Default.Filename == nil {
+		filename := "index"
+		cfg.Default.Filename = &filename
+	}
+	if cfg.Default.Browse == nil {
+		browse := false
+		cfg.Default.Browse = &browse
+	}
+	if cfg.Default.Nested == nil {
+		nested := "follow"
+		cfg.Default.Nested = &nested
+	}
+	err = discover(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
 }
 
-func usage() {
-	fmt.Fprintln(os.Stderr, "usage: govanity [flags]")
-	flag.PrintDefaults()
-	os.Exit(2)
-}
+// collect resolves the imports of cfg and returns the pages for them and
+// for their sub-directories, sorted by import.  The pages of the imports
+// that did not change since the state st was recorded are taken from it;
+// st may be nil.  If some of the imports fail, collect returns the pages
+// of the others together with an entryErrors error.
+func collect(cfg *config, st *state) ([]page, error) {
+	keys := make([]string, 0, len(cfg.Import))
+	for k := range cfg.Import {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	errs := make([]error, len(keys))
+	for i, k := range keys {
+		errs[i] = resolve(cfg, k)
+	}
+
+	// Look up the latest versions for the badges.
+	parallel(len(keys), func(i int) {
+		e := cfg.Import[keys[i]]
+		if errs[i] == nil && *e.Badge {
+			e.version, errs[i] = latestVersion(*e.VCS, *e.Repo)
+			if errs[i] != nil {
+				errs[i] = fmt.Errorf("%q: badge: %v", keys[i], errs[i])
+			}
+		}
+	})
+
+	// The directories of configured imports below another import
+	// belong to the former.
+	configured := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		if e := cfg.Import[k]; e.imprt != nil {
+			configured[*e.imprt] = true
+		}
+	}
+	owner := func(imprt string) string {
+		for q := imprt; strings.Contains(q, "/"); q = path.Dir(q) {
+			if configured[q] {
+				return q
+			}
+		}
+		return ""
+	}
+
+	// Skip the imports that did not change.  Their pages also depend on
+	// the source directory and on the configured imports below them.
+	src := make([]string, len(keys))
+	cached := make([][]page, len(keys))
+	for i, k := range keys {
+		if errs[i] != nil {
+			continue
+		}
+		e := cfg.Import[k]
+		src[i] = srcDir(*e.imprt)
+		if e.src != "" {
+			src[i] = e.src
+		}
+		var nested []string
+		for q := range configured {
+			if strings.HasPrefix(q, *e.imprt+"/") {
+				nested = append(nested, q)
+			}
+		}
+		sort.Strings(nested)
+		e.hash = entryHash(e, src[i], nested)
+		if st != nil {
+			cached[i] = st.pages(cfg, e)
+		}
+	}
 
-func govanity() {
-	for k, e := range cfg.Import {
-		if e.Root == nil {
-			e.Root = cfg.Default.Root
+	// Walk the directories of all imports, in the GOPATH, in the
+	// workspace or in a clone of the repository.
+	cloned := make([]bool, len(keys))
+	dirs := make([][]walkedDir, len(keys))
+	parallel(len(keys), func(i int) {
+		e := cfg.Import[keys[i]]
+		if errs[i] != nil || cached[i] != nil || !*e.Dirs && !*e.Landing {
+			return
+		}
+		if e.Ref != nil && *e.Ref != "" {
+			if *e.VCS != "git" {
+				errs[i] = fmt.Errorf("%q: ref requires vcs git", keys[i])
+				return
+			}
+			src[i], errs[i] = clone(*e.Repo, *e.Ref)
+			cloned[i] = errs[i] == nil
+			if errs[i] != nil {
+				errs[i] = fmt.Errorf("%q: %v", keys[i], errs[i])
+				return
+			}
 		}
-		if e.Repo == nil {
-			e.Repo = cfg.Default.Repo
+		if *e.Dirs {
+			var exclude []string
+			if e.Exclude != nil {
+				exclude = strings.Fields(*e.Exclude)
+			}
+			dirs[i], errs[i] = walk(src[i], exclude, *e.Nested == "skip")
+			if errs[i] != nil {
+				errs[i] = fmt.Errorf("%q: %v", keys[i], errs[i])
+			}
 		}
-		if e.VCS == nil {
-			e.VCS = cfg.Default.VCS
+	})
+	defer func() {
+		for i := range keys {
+			if cloned[i] {
+				os.RemoveAll(src[i])
+			}
 		}
-		if e.Redirect == nil {
-			e.Redirect = cfg.Default.Redirect
+	}()
+
+	// Look for import comments in the found directories,
+	// and for the package documentation of the landing pages.
+	type dir struct {
+		i     int
+		f     string
+		imprt string // from the go.mod file
+		root  bool
+		pkg   *build.Package
+	}
+	var pkgs []dir
+	for i, k := range keys {
+		if errs[i] == nil && cached[i] == nil && *cfg.Import[k].Landing {
+			pkgs = append(pkgs, dir{i: i, f: src[i], root: true})
 		}
-		if e.Dirs == nil {
-			e.Dirs = cfg.Default.Dirs
+		for _, d := range dirs[i] {
+			pkgs = append(pkgs, dir{i: i, f: d.f, imprt: d.imprt})
 		}
+	}
+	parallel(len(pkgs), func(i int) {
+		pkgs[i].pkg, _ = build.ImportDir(pkgs[i].f, build.ImportComment)
+	})
 
-		if e.Repo == nil || *e.Repo == "" {
-			log.Fatalf("%q: repo is not set\n", k)
+	var pages []page
+	var failed entryErrors
+	j := 0
+	for i, k := range keys {
+		if errs[i] != nil {
+			failed = append(failed, entryError{*cfg.Import[k].imprt, errs[i]})
+			continue
+		}
+		if cached[i] != nil {
+			pages = append(pages, cached[i]...)
+			continue
 		}
+		e := cfg.Import[k]
+		p := page{dir: *e.imprt, e: *e}
+		if j < len(pkgs) && pkgs[j].i == i && pkgs[j].root {
+			p.pkg = pkgs[j].pkg
+			j++
+		}
+		pages = append(pages, p)
+		for ; j < len(pkgs) && pkgs[j].i == i; j++ {
+			// The import path of a directory in a module is given by
+			// the go.mod file, otherwise by the import comment.
+			d := pkgs[j]
+			imprt := d.pkg.ImportComment
+			if d.imprt != "" {
+				imprt = d.imprt
+				if d.pkg.Name == "" {
+					continue
+				}
+			}
+			if !strings.HasPrefix(imprt, *e.imprt+"/") {
+				// Modules elsewhere cannot be served with this import.
+				continue
+			}
+			if owner(imprt) != *e.imprt {
+				continue
+			}
+			e := *e
+			if e.Redirect != nil && *e.Redirect != "" {
+				redirect := *e.Redirect
+				redirect += strings.TrimPrefix(imprt, *e.imprt)
+				e.Redirect = &redirect
+			}
+			pages = append(pages, page{dir: imprt, e: e, pkg: d.pkg})
+		}
+	}
+	pages = uniquePages(pages)
+	if failed != nil {
+		return pages, failed
+	}
+	return pages, nil
+}
 
-		e.imprt = &k
-		if e.Root != nil {
-			s := path.Join(*e.Root, *e.imprt)
-			e.imprt = &s
+// uniquePages drops the pages whose files are those of another page, so
+// that every file is written once.  The pages of the configured imports win
+// over those of walked directories, and otherwise the earlier page wins.
+func uniquePages(pages []page) []page {
+	seen := make(map[string]bool)
+	drop := make([]bool, len(pages))
+	for _, imports := range []bool{true, false} {
+		for i, p := range pages {
+			if (p.dir == *p.e.imprt) != imports {
+				continue
+			}
+			for _, name := range p.names() {
+				if seen[name] {
+					warnf("skipping %s: %s is written for another import", p.dir, name)
+					drop[i] = true
+					break
+				}
+			}
+			if !drop[i] {
+				for _, name := range p.names() {
+					seen[name] = true
+				}
+			}
 		}
-		r := strings.NewReplacer("*", *e.imprt, "$", path.Base(k))
-		s := r.Replace(*e.Repo)
-		e.Repo = &s
-		if e.Redirect != nil {
-			s := r.Replace(*e.Redirect)
-			e.Redirect = &s
+	}
+	var unique []page
+	for i, p := range pages {
+		if !drop[i] {
+			unique = append(unique, p)
 		}
 	}
+	return unique
+}
+
+// An entryError is the failure of a single import.
+type entryError struct {
+	imprt string // full import path
+	err   error
+}
+
+// entryErrors are the failures of single imports, which do not keep
+// the others from being generated.
+type entryErrors []entryError
+
+func (errs entryErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = e.err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// imports returns the import paths of the failed imports.
+func (errs entryErrors) imports() map[string]bool {
+	m := make(map[string]bool)
+	for _, e := range errs {
+		m[e.imprt] = true
+	}
+	return m
+}
+
+// report prints a summary of the failures, if any, out of n imports.
+func (errs entryErrors) report(n int) {
+	if errs == nil {
+		return
+	}
+	log.Printf("%d of %d imports failed:", len(errs.imports()), n)
+	for _, e := range errs {
+		fmt.Fprintf(os.Stderr, "\t%v\n", e.err)
+	}
+}
+
+// collectAll returns the pages of all imports of cfg for the commands
+// other than generate.  The imports that failed are reported and returned,
+// and the pages of the others are returned nevertheless.
+func collectAll(cfg *config) ([]page, entryErrors) {
+	pages, err := collect(cfg, nil)
+	failed, partial := err.(entryErrors)
+	if !partial {
+		ck(err)
+	}
+	failed.report(len(cfg.Import))
+	return pages, failed
+}
 
+// inherit sets the entries of e that are not defined to those of d,
+// except for the meta tags and head snippets, which are combined.
+func inherit(e, d *entry) {
+	if e.Root == nil {
+		e.Root = d.Root
+	}
+	if e.Repo == nil {
+		e.Repo = d.Repo
+	}
+	if e.VCS == nil {
+		e.VCS = d.VCS
+	}
+	if e.Redirect == nil {
+		e.Redirect = d.Redirect
+	}
+	if e.NoRedirect == nil {
+		e.NoRedirect = d.NoRedirect
+	}
+	if e.Dirs == nil {
+		e.Dirs = d.Dirs
+	}
+	if e.Exclude == nil {
+		e.Exclude = d.Exclude
+	}
+	if e.Landing == nil {
+		e.Landing = d.Landing
+	}
+	if e.Ref == nil {
+		e.Ref = d.Ref
+	}
+	if e.Badge == nil {
+		e.Badge = d.Badge
+	}
+	if e.Delay == nil {
+		e.Delay = d.Delay
+	}
+	if e.CacheControl == nil {
+		e.CacheControl = d.CacheControl
+	}
+	if e.ETag == nil {
+		e.ETag = d.ETag
+	}
+	if e.Nested == nil {
+		e.Nested = d.Nested
+	}
+	if e.Browse == nil {
+		e.Browse = d.Browse
+	}
+	if e.Filename == nil {
+		e.Filename = d.Filename
+	}
+	if e.Allow == nil {
+		e.Allow = d.Allow
+	}
+	if e.BasicAuth == nil {
+		e.BasicAuth = d.BasicAuth
+	}
+	if e.BearerToken == nil {
+		e.BearerToken = d.BearerToken
+	}
+	if e.BrowseURL == nil {
+		e.BrowseURL = d.BrowseURL
+	}
+}
+
+// resolve applies the profile and the defaults of cfg to the import k
+// and replaces the placeholders in its entries.
+func resolve(cfg *config, k string) error {
+	e := cfg.Import[k]
+	if e.Profile == nil {
+		e.Profile = cfg.Default.Profile
+	}
+	var p *entry
+	if e.Profile != nil && *e.Profile != "" {
+		p = cfg.Profile[*e.Profile]
+		if p != nil {
+			inherit(e, p)
+		}
+	}
+	inherit(e, &cfg.Default)
+	e.imprt = &k
+	root := ""
+	if e.Root != nil {
+		root = *e.Root
+		s := path.Join(root, *e.imprt)
+		e.imprt = &s
+	}
+	if e.Profile != nil && *e.Profile != "" && p == nil {
+		return fmt.Errorf("%q: unknown profile %q", k, *e.Profile)
+	}
+	if *e.Nested != "follow" && *e.Nested != "skip" {
+		return fmt.Errorf("%q: nested must be follow or skip", k)
+	}
+	if *e.Filename != "index" && *e.Filename != "html" && *e.Filename != "both" {
+		return fmt.Errorf("%q: filename must be index, html or both", k)
+	}
+	if e.Delay != nil && *e.Delay < 0 {
+		return fmt.Errorf("%q: delay must not be negative", k)
+	}
+
+	if e.Repo == nil || *e.Repo == "" {
+		return fmt.Errorf("%q: repo is not set", k)
+	}
+
+	s, err := expandExpr(*e.Repo, *e.imprt, k, root)
+	if err != nil {
+		return fmt.Errorf("%q: repo: %v", k, err)
+	}
+	e.Repo = &s
+	if e.VCS == nil {
+		s := guessVCS(*e.Repo)
+		e.VCS = &s
+	}
+	err = checkVCS(*e.VCS, *e.Repo)
+	if err != nil {
+		return fmt.Errorf("%q: %v", k, err)
+	}
+	if e.Redirect != nil && *e.Redirect == "none" {
+		s := ""
+		e.Redirect = &s
+	}
+	if e.Redirect != nil {
+		s, err := expandExpr(*e.Redirect, *e.imprt, k, root)
+		if err != nil {
+			return fmt.Errorf("%q: redirect: %v", k, err)
+		}
+		e.Redirect = &s
+	}
+
+	// The meta tags and head snippets of the default section come first,
+	// followed by those of the profile.
+	meta := append([]string(nil), cfg.Default.Meta...)
+	head := append([]string(nil), cfg.Default.Head...)
+	if p != nil {
+		meta = append(meta, p.Meta...)
+		head = append(head, p.Head...)
+	}
+	e.Meta = append(meta, e.Meta...)
+	e.Head = append(head, e.Head...)
+	for i, v := range e.Meta {
+		e.Meta[i], err = expandExpr(v, *e.imprt, k, root)
+		if err != nil {
+			return fmt.Errorf("%q: meta: %v", k, err)
+		}
+		if _, _, ok := splitMeta(e.Meta[i]); !ok {
+			return fmt.Errorf("%q: meta: %q has no content", k, e.Meta[i])
+		}
+	}
+	// The secrets can be taken from the environment.
+	for _, secrets := range []*[]string{&e.BasicAuth, &e.BearerToken} {
+		var expanded []string
+		for _, v := range *secrets {
+			v, err = expand(v, *e.imprt, k, root)
+			if err != nil {
+				return fmt.Errorf("%q: %v", k, err)
+			}
+			expanded = append(expanded, v)
+		}
+		*secrets = expanded
+	}
+	if e.NoRedirect != nil && *e.NoRedirect != "" {
+		err = loadNoRedirect(cfg, e)
+		if err != nil {
+			return fmt.Errorf("%q: noredirect-template: %v", k, err)
+		}
+	}
+	e.access, err = newAccess(e)
+	if err != nil {
+		return fmt.Errorf("%q: %v", k, err)
+	}
+	if *e.Browse {
+		e.browse, err = browseTemplate(e)
+		if err != nil {
+			return fmt.Errorf("%q: browse: %v", k, err)
+		}
+	}
+	return nil
+}
+
+// templatePaths makes the noredirect-template paths set by the configuration
+// file just read relative to its directory dir.  gcfg reuses the strings of
+// the entries, so seen records their values after the previous file.
+func templatePaths(cfg *config, dir string, seen map[*string]string) {
+	entries := []*entry{&cfg.Default}
 	for _, e := range cfg.Import {
-		writeFile(*e.imprt, *e)
-		if !*e.Dirs {
+		entries = append(entries, e)
+	}
+	for _, e := range cfg.Profile {
+		entries = append(entries, e)
+	}
+	for _, e := range entries {
+		f := e.NoRedirect
+		if f == nil || *f == "" {
+			continue
+		}
+		if v, ok := seen[f]; ok && v == *f {
 			continue
 		}
-		root := filepath.Join(build.Default.GOPATH, "src", *e.imprt)
-		err := filepath.Walk(root, func(f string, info os.FileInfo, err error) error {
+		if !filepath.IsAbs(*f) {
+			*f = filepath.Join(dir, *f)
+		}
+		seen[f] = *f
+	}
+}
+
+// loadNoRedirect parses the noredirect-template of the entry e.  The
+// templates are parsed once per file and kept in cfg.
+func loadNoRedirect(cfg *config, e *entry) error {
+	f := *e.NoRedirect
+	data, err := ioutil.ReadFile(f)
+	if err != nil {
+		return err
+	}
+	t, ok := cfg.templates[f]
+	if !ok {
+		t, err = template.New(filepath.Base(f)).Parse(string(data))
+		if err != nil {
+			return err
+		}
+		if cfg.templates == nil {
+			cfg.templates = make(map[string]*template.Template)
+		}
+		cfg.templates[f] = t
+	}
+	e.noRedirect, e.noRedirectSrc = t, string(data)
+	return nil
+}
+
+// clone makes a shallow clone of the branch or tag ref of the git
+// repository repo in a new temporary directory.  If ref is empty,
+// the default branch is cloned.
+func clone(repo, ref string) (string, error) {
+	dir, err := ioutil.TempDir("", "govanity")
+	if err != nil {
+		return "", err
+	}
+	args := []string{"clone", "--quiet", "--depth", "1"}
+	if ref != "" {
+		args = append(args, "--branch", ref)
+	}
+	cmd := exec.Command("git", append(args, "--", repo, dir)...)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("git clone %s: %v\n%s", repo, err, out)
+	}
+	return dir, nil
+}
+
+// govanity writes the files for pages.
+func govanity(pages []page) entryErrors {
+	events := make([][]fileEvent, len(pages))
+	errs := make([]error, len(pages))
+	parallel(len(pages), func(i int) {
+		p := pages[i]
+		if p.cached {
+			mu.Lock()
+			for _, name := range p.names() {
+				written[name] = p.sum
+				events[i] = append(events[i], fileEvent{"skipped", outFile(name)})
+			}
+			mu.Unlock()
+		} else {
+			var data []byte
+			data, errs[i] = render(p, false)
+			for _, name := range p.names() {
+				if errs[i] != nil {
+					break
+				}
+				var ev fileEvent
+				ev, errs[i] = writeFile(name, data)
+				events[i] = append(events[i], ev)
+			}
+		}
+		if errs[i] == nil && *p.e.Badge {
+			// The versions change without the entry, so the
+			// badges are written for the cached pages as well.
+			var data []byte
+			var ev fileEvent
+			data, errs[i] = renderBadge(p)
+			if errs[i] == nil {
+				ev, errs[i] = writeFile(p.badgeName(), data)
+				events[i] = append(events[i], ev)
+			}
+		}
+	})
+	var failed entryErrors
+	for i, evs := range events {
+		for _, ev := range evs {
+			logEvent(ev)
+		}
+		if errs[i] != nil {
+			failed = append(failed, entryError{*pages[i].e.imprt, errs[i]})
+		}
+	}
+	return failed
+}
+
+// A page is an import page for the import path dir.
+type page struct {
+	dir    string
+	e      entry
+	pkg    *build.Package // nil if not known
+	cached bool           // unchanged since the last run
+	sum    [sha256.Size]byte
+}
+
+// path returns the directory of the page, relative to the output directory.
+func (p page) path() string {
+	if *layout == "full" {
+		if p.e.Root == nil || *p.e.Root == "" {
+			return p.dir
+		}
+		return strings.TrimPrefix(p.dir, *p.e.Root+"/")
+	}
+	return stripHost(p.dir)
+}
+
+// stripHost returns imprt without its first path element.
+func stripHost(imprt string) string {
+	split := strings.SplitN(imprt, "/", 2)
+	return split[len(split)-1]
+}
+
+// name returns the file name of the page, relative to the output directory.
+// With ``filename = both'', it is the first of its names.
+func (p page) name() string {
+	return p.names()[0]
+}
+
+// names returns the file names of the page, relative to the output
+// directory, according to the ``filename'' entry.  The page of the root
+// of the output directory is always written as index.html.
+func (p page) names() []string {
+	index := path.Join(p.path(), "index.html")
+	if p.path() == "" || p.path() == "." {
+		return []string{index}
+	}
+	switch *p.e.Filename {
+	case "html":
+		return []string{p.path() + ".html"}
+	case "both":
+		return []string{index, p.path() + ".html"}
+	}
+	return []string{index}
+}
+
+// url returns the URL of the page, matching the ``filename'' entry:
+// without a trailing slash for html, which hosts serve for the
+// path without the extension.
+func (p page) url() string {
+	if *p.e.Filename == "html" {
+		return "https://" + p.dir
+	}
+	return "https://" + p.dir + "/"
+}
+
+// walk returns the sub-directories of root, excluding vendor directories,
+// the directories ignored by the go tool and the directories matching one of
+// the exclude patterns.  The import paths of the directories in a module are
+// derived from the path in its go.mod file.  With skipNested, the directories
+// of modules nested in root are skipped.
+func walk(root string, exclude []string, skipNested bool) ([]walkedDir, error) {
+	var dirs []walkedDir
+	mods := make(map[string]string) // import paths by directory
+	err := filepath.Walk(root, func(f string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			data, err := ioutil.ReadFile(filepath.Join(f, "go.mod"))
+			if err == nil && (f == root || !skipNested) {
+				mods[f] = modulePath(data)
+			} else if err == nil {
+				return filepath.SkipDir
+			} else if mod := mods[filepath.Dir(f)]; mod != "" && f != root {
+				mods[f] = mod + "/" + info.Name()
+			}
+			if f == root {
+				return nil
+			}
+			name := info.Name()
+			if name == "vendor" || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") {
+				return filepath.SkipDir
+			}
+			rel, err := filepath.Rel(root, f)
 			if err != nil {
 				return err
 			}
-			if info.IsDir() {
-				if f == root {
-					return nil
-				}
-				if info.Name() == "vendor" {
-					return filepath.SkipDir
-				}
-				pkg, _ := build.ImportDir(f, build.ImportComment)
-				if pkg.ImportComment != "" {
-					e := *e
-					if e.Redirect != nil {
-						redirect := *e.Redirect
-						redirect += strings.TrimPrefix(pkg.ImportComment, *e.imprt)
-						e.Redirect = &redirect
-					}
-					writeFile(pkg.ImportComment, e)
+			if excluded(filepath.ToSlash(rel), exclude) {
+				return filepath.SkipDir
+			}
+			dirs = append(dirs, walkedDir{f, mods[f]})
+		}
+		return nil
+	})
+	return dirs, err
+}
+
+// A walkedDir is a directory found by walk.
+type walkedDir struct {
+	f     string
+	imprt string // import path by the go.mod file, if any
+}
+
+// excluded reports whether the directory rel, relative to the walked root,
+// matches one of the patterns.  A pattern without a slash is matched against
+// the name of the directory, otherwise against rel.
+func excluded(rel string, patterns []string) bool {
+	for _, pat := range patterns {
+		if !strings.Contains(pat, "/") {
+			if ok, _ := path.Match(pat, path.Base(rel)); ok {
+				return true
+			}
+			continue
+		}
+		if match(strings.Split(pat, "/"), strings.Split(rel, "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// match matches the path elements elems against the pattern elements pat,
+// where ``**'' matches any number of elements.
+func match(pat, elems []string) bool {
+	for len(pat) > 0 {
+		if pat[0] == "**" {
+			for i := 0; i <= len(elems); i++ {
+				if match(pat[1:], elems[i:]) {
+					return true
 				}
 			}
-			return nil
-		})
-		ck(err)
+			return false
+		}
+		if len(elems) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pat[0], elems[0]); !ok {
+			return false
+		}
+		pat, elems = pat[1:], elems[1:]
+	}
+	return len(elems) == 0
+}
+
+// parallel calls f for all i in [0, n), running at most -j calls at once.
+func parallel(n int, f func(i int)) {
+	sem := make(chan struct{}, *jobs)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			f(i)
+			<-sem
+		}(i)
+	}
+	wg.Wait()
+}
+
+// expand replaces the placeholders in s.  imprt is the full import path,
+// k the import path without the root domain.
+func expand(s, imprt, k, root string) (string, error) {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '*' && i+1 < len(s) && s[i+1] == '*',
+			c == '$' && i+1 < len(s) && s[i+1] == '$',
+			c == '%' && i+1 < len(s) && s[i+1] == '%':
+			sb.WriteByte(c)
+			i++
+		case c == '*':
+			sb.WriteString(imprt)
+		case c == '$' && i+1 < len(s) && s[i+1] == '{':
+			j := strings.IndexByte(s[i:], '}')
+			if j < 0 {
+				return "", fmt.Errorf("unterminated ${ in %q", s)
+			}
+			name := s[i+2 : i+j]
+			v, ok := os.LookupEnv(name)
+			if !ok {
+				return "", fmt.Errorf("environment variable %s is not set", name)
+			}
+			sb.WriteString(v)
+			i += j
+		case c == '$':
+			sb.WriteString(path.Base(k))
+		case c == '%' && i+1 < len(s) && strings.IndexByte("irb", s[i+1]) >= 0:
+			switch s[i+1] {
+			case 'i':
+				sb.WriteString(k)
+			case 'r':
+				sb.WriteString(root)
+			case 'b':
+				sb.WriteString(path.Base(k))
+			}
+			i++
+		default:
+			sb.WriteByte(c)
+		}
 	}
+	return sb.String(), nil
 }
 
+// splitMeta splits the meta entry s into the name and the content,
+// separated by any white space.  It reports whether both are present.
+func splitMeta(s string) (name, content string, ok bool) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, unicode.IsSpace)
+	if i < 0 {
+		return s, "", false
+	}
+	return s[:i], strings.TrimSpace(s[i:]), true
+}
+
+// extra are the additional meta tags and head snippets of the templates.
+const extra = `{{range .Meta}}<meta {{if .Property}}property{{else}}name{{end}}="{{.Name}}" content="{{.Content}}">
+{{end}}{{range .Head}}{{.}}
+{{end}}`
+
 var tmpl = template.Must(template.New("main").Parse(`<!DOCTYPE html>
 <html>
 <head>
 <meta charset="utf-8">
 <meta name="go-import" content="{{.Import}} {{.VCS}} {{.Repo}}">
-<meta http-equiv="refresh" content="0; url={{.Redirect}}">
-</head>
+<meta http-equiv="refresh" content="{{.Delay}}; url={{.Redirect}}">
+` + extra + `</head>
 <body>
 Redirecting to <a href="{{.Redirect}}">{{.Redirect}}</a>...
 </body>
@@ -217,52 +1593,195 @@ var tmplnr = template.Must(template.New("main").Parse(`<!DOCTYPE html>
 <head>
 <meta charset="utf-8">
 <meta name="go-import" content="{{.Import}} {{.VCS}} {{.Repo}}">
-</head>
+` + extra + `</head>
+</html>
+`))
+
+var tmpllanding = template.Must(template.New("main").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="go-import" content="{{.Import}} {{.VCS}} {{.Repo}}">
+{{if .Refresh}}<meta http-equiv="refresh" content="{{.Delay}}; url={{.Redirect}}">
+{{end}}<title>{{.Path}}</title>
+` + extra + `</head>
+<body>
+<h1>{{.Path}}</h1>
+{{if .Synopsis}}<p>{{.Synopsis}}</p>
+{{end}}<pre>{{.Install}}</pre>
+<p><a href="{{.Docs}}"><img src="https://pkg.go.dev/badge/{{.Path}}.svg" alt="Go Reference"></a></p>
+<ul>
+<li><a href="{{.Docs}}">Documentation</a></li>
+<li><a href="{{.Repo}}">Source</a></li>
+</ul>
+</body>
 </html>
 `))
 
-func writeFile(dir string, e entry) {
+// render executes the template for p.  With goget, it renders
+// the document for the go tool, which contains only the meta tags.
+func render(p page, goget bool) ([]byte, error) {
+	e := p.e
 	t := tmpl
-	if e.Redirect == nil || *e.Redirect == "" {
+	switch {
+	case goget:
+		t = tmplnr
+	case *e.Landing:
+		t = tmpllanding
+	case (e.Redirect == nil || *e.Redirect == "") && e.noRedirect != nil:
+		t = e.noRedirect
+	case e.Redirect == nil || *e.Redirect == "":
+		t = tmplnr
+	}
+	if e.Redirect == nil {
 		s := ""
 		e.Redirect = &s
-		t = tmplnr
+	}
+	type meta struct {
+		Name     string
+		Content  string
+		Property bool
 	}
 	d := struct {
 		Import   string
 		Repo     string
 		VCS      string
 		Redirect string
-	}{*e.imprt, *e.Repo, *e.VCS, *e.Redirect}
-
-	var sb strings.Builder
-	err := t.Execute(&sb, d)
-	ck(err)
-	new := sb.String()
+		Delay    int
+		Refresh  bool
+		Path     string
+		Synopsis string
+		Install  string
+		Docs     string
+		Meta     []meta
+		Head     []template.HTML
+	}{*e.imprt, *e.Repo, *e.VCS, *e.Redirect, 0, false, p.dir, "", "go get " + p.dir, *e.Redirect, nil, nil}
+	if e.Delay != nil {
+		// Landing pages only redirect with an explicit delay.
+		d.Delay = *e.Delay
+		d.Refresh = *e.Redirect != ""
+	}
+	if !goget {
+		for _, m := range e.Meta {
+			name, content, _ := splitMeta(m)
+			d.Meta = append(d.Meta, meta{name, content, strings.Contains(name, ":")})
+		}
+		for _, h := range e.Head {
+			d.Head = append(d.Head, template.HTML(h))
+		}
+	}
+	if p.pkg != nil {
+		d.Synopsis = doc.Synopsis(p.pkg.Doc)
+		if p.pkg.IsCommand() {
+			d.Install = "go install " + p.dir + "@latest"
+		}
+	}
+	if d.Docs == "" {
+		d.Docs = "https://pkg.go.dev/" + p.dir
+	}
 
-	split := strings.SplitN(dir, "/", 2)
-	f := path.Join(*outdir, split[len(split)-1])
-	err = os.MkdirAll(f, os.ModePerm)
-	ck(err)
+	var buf bytes.Buffer
+	err := t.Execute(&buf, d)
+	return buf.Bytes(), err
+}
 
-	exists := false
-	f += "/index.html"
+// writeFile writes data to the file name in the output directory and returns
+// the event to report.  If the output is an archive, data is kept for
+// writeArchive instead, and with -diff, the file is not written at all.
+func writeFile(name string, data []byte) (fileEvent, error) {
+	mu.Lock()
+	written[name] = sha256.Sum256(data)
+	if *compress {
+		contents[name] = data
+	}
+	if archiveFormat() != "" {
+		archived[name] = data
+		mu.Unlock()
+		return fileEvent{}, nil
+	}
+	mu.Unlock()
+	f := outFile(name)
+	ev := fileEvent{"created", f}
 	old, err := ioutil.ReadFile(f)
 	if err == nil {
-		exists = true
-		if new == string(old) {
-			return
+		if bytes.Equal(data, old) {
+			return fileEvent{"skipped", f}, nil
 		}
+		ev.Event = "updated"
+	}
+	if *diff {
+		return ev, nil
 	}
+	err = os.MkdirAll(filepath.Dir(f), os.ModePerm)
+	if err != nil {
+		return ev, err
+	}
+	return ev, ioutil.WriteFile(f, data, os.ModePerm)
+}
 
-	if *verbose {
-		if exists {
-			fmt.Printf("updating %s\n", f)
-		} else {
-			fmt.Printf("creating %s\n", f)
+// outFile returns the path of the file name, relative to the output
+// directory and separated by slashes like all generated names.
+func outFile(name string) string {
+	return filepath.Join(*outdir, filepath.FromSlash(name))
+}
+
+// mu protects written.
+var mu sync.Mutex
+
+// written maps the names of the generated files, relative to the
+// output directory, to the SHA-256 hashes of their contents.
+var written = map[string][sha256.Size]byte{}
+
+// writeManifest writes the hashes of all generated files to f,
+// sorted by file name.
+func writeManifest(f string) {
+	names := make([]string, 0, len(written))
+	for name := range written {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&sb, "%x  %s\n", written[name], name)
+	}
+	err := ioutil.WriteFile(f, []byte(sb.String()), 0666)
+	ck(err)
+}
+
+// A mapping is the JSON representation of a page.
+type mapping struct {
+	Import   string `json:"import"`
+	Prefix   string `json:"prefix"`
+	VCS      string `json:"vcs"`
+	Repo     string `json:"repo"`
+	Redirect string `json:"redirect,omitempty"`
+	File     string `json:"file"`
+}
+
+// mappings returns the mappings of pages.
+func mappings(pages []page) []mapping {
+	m := make([]mapping, len(pages))
+	for i, p := range pages {
+		m[i] = mapping{
+			Import: p.dir,
+			Prefix: *p.e.imprt,
+			VCS:    *p.e.VCS,
+			Repo:   *p.e.Repo,
+			File:   p.name(),
+		}
+		if p.e.Redirect != nil {
+			m[i].Redirect = *p.e.Redirect
 		}
 	}
-	err = ioutil.WriteFile(f, []byte(new), os.ModePerm)
+	return m
+}
+
+// writeJSON writes the mappings of pages to f.
+func writeJSON(f string, pages []page) {
+	data, err := json.MarshalIndent(mappings(pages), "", "\t")
+	ck(err)
+	err = ioutil.WriteFile(f, append(data, '\n'), 0666)
 	ck(err)
 }
 
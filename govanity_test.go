@@ -0,0 +1,90 @@
+package main
+
+import "testing"
+
+func TestExpand(t *testing.T) {
+	t.Setenv("GOVANITY_TEST", "secret")
+	tests := []struct {
+		s, want string
+	}{
+		{"https://github.com/rtrn/$", "https://github.com/rtrn/govanity"},
+		{"https://godoc.org/*", "https://godoc.org/rtrn.io/cmd/govanity"},
+		{"https://example.com/%r/%i/%b", "https://example.com/rtrn.io/cmd/govanity/govanity"},
+		{"https://${GOVANITY_TEST}@example.com/$", "https://secret@example.com/govanity"},
+		{"a**b$$c%%d", "a*b$c%d"},
+		{"https://example.com/%e4%%b8%ad", "https://example.com/%e4%b8%ad"},
+		{"100%", "100%"},
+		{"%x", "%x"},
+		{"$", "govanity"},
+	}
+	for _, tt := range tests {
+		got, err := expand(tt.s, "rtrn.io/cmd/govanity", "cmd/govanity", "rtrn.io")
+		if err != nil {
+			t.Errorf("expand(%q): %v", tt.s, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("expand(%q) = %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestExpandErrors(t *testing.T) {
+	for _, s := range []string{
+		"https://${GOVANITY_TEST_UNSET}/",
+		"https://${GOVANITY_TEST",
+	} {
+		if got, err := expand(s, "rtrn.io/x", "x", "rtrn.io"); err == nil {
+			t.Errorf("expand(%q) = %q, want error", s, got)
+		}
+	}
+}
+
+func TestExcluded(t *testing.T) {
+	patterns := []string{"testdata", "internal/*", "third_party/**", "**/gen", "x?z"}
+	tests := []struct {
+		rel  string
+		want bool
+	}{
+		{"testdata", true},
+		{"a/b/testdata", true},
+		{"testdata2", false},
+		{"internal/foo", true},
+		{"internal", false},
+		{"internal/foo/bar", false},
+		{"a/internal/foo", false},
+		{"third_party", true},
+		{"third_party/a/b", true},
+		{"gen", true},
+		{"a/b/gen", true},
+		{"xyz", true},
+		{"a/xyz", true},
+		{"cmd/govanity", false},
+	}
+	for _, tt := range tests {
+		if got := excluded(tt.rel, patterns); got != tt.want {
+			t.Errorf("excluded(%q) = %v, want %v", tt.rel, got, tt.want)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pat, elems []string
+		want       bool
+	}{
+		{[]string{"a", "b"}, []string{"a", "b"}, true},
+		{[]string{"a", "*"}, []string{"a", "b"}, true},
+		{[]string{"a", "*"}, []string{"a"}, false},
+		{[]string{"a", "**"}, []string{"a"}, true},
+		{[]string{"**", "b"}, []string{"a", "x", "b"}, true},
+		{[]string{"**", "b"}, []string{"a", "b", "c"}, false},
+		{[]string{"a", "**", "c"}, []string{"a", "c"}, true},
+		{[]string{"[ab]"}, []string{"c"}, false},
+	}
+	for _, tt := range tests {
+		if got := match(tt.pat, tt.elems); got != tt.want {
+			t.Errorf("match(%q, %q) = %v, want %v", tt.pat, tt.elems, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// maxCrawl is the maximum number of pages crawled on a live site.
+const maxCrawl = 1000
+
+// A crawledPage is a page of an existing vanity site.
+type crawledPage struct {
+	path     string // slash-separated path on the site
+	imports  []metaImport
+	source   string // content of the go-source meta tag
+	redirect string // URL of the refresh meta tag or HTTP redirection
+	links    []string
+}
+
+// cmdImport runs the import command.
+func cmdImport(args []string) {
+	if len(args) != 1 {
+		usage()
+	}
+	var pages []crawledPage
+	var err error
+	if strings.HasPrefix(args[0], "http://") || strings.HasPrefix(args[0], "https://") {
+		pages, err = crawlSite(args[0])
+	} else {
+		pages, err = crawlDir(args[0])
+	}
+	ck(err)
+	cfg, err := importConfig(pages)
+	ck(err)
+	fmt.Printf("# Imported from %s.\n%s", args[0], cfg)
+}
+
+// crawlDir reads the HTML files in the directory dir.
+func crawlDir(dir string) ([]crawledPage, error) {
+	var pages []crawledPage
+	err := filepath.Walk(dir, func(f string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() || filepath.Ext(f) != ".html" {
+			return err
+		}
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, f)
+		if err != nil {
+			return err
+		}
+		p := strings.TrimSuffix(filepath.ToSlash(rel), ".html")
+		if path.Base(p) == "index" {
+			p = path.Dir(p)
+		}
+		pg, err := parsePage(p, data)
+		if err != nil {
+			return fmt.Errorf("%s: %v", f, err)
+		}
+		if *verbose {
+			fmt.Fprintf(os.Stderr, "reading %s\n", f)
+		}
+		pages = append(pages, pg)
+		return nil
+	})
+	return pages, err
+}
+
+// crawlSite crawls the live site at the URL site, following the links
+// to other pages on the same host.
+func crawlSite(site string) ([]crawledPage, error) {
+	start, err := url.Parse(site)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{
+		// Redirections are recorded, not followed.
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	var pages []crawledPage
+	seen := map[string]bool{}
+	queue := []string{sitePath(start.Path)}
+	for len(queue) > 0 && len(pages) < maxCrawl {
+		p := queue[0]
+		queue = queue[1:]
+		if seen[p] {
+			continue
+		}
+		seen[p] = true
+		u := *start
+		u.Path = "/"
+		if p != "." {
+			u.Path += p
+		}
+		u.RawQuery = ""
+		if *verbose {
+			fmt.Fprintf(os.Stderr, "fetching %s\n", u.String())
+		}
+		pg, err := fetchPage(client, &u, p)
+		if err != nil {
+			return nil, err
+		}
+		if pg == nil {
+			continue
+		}
+		pages = append(pages, *pg)
+		for _, l := range pg.links {
+			lu, err := u.Parse(l)
+			if err != nil || lu.Host != start.Host {
+				continue
+			}
+			queue = append(queue, sitePath(lu.Path))
+		}
+	}
+	if len(pages) >= maxCrawl && len(queue) > 0 {
+		warnf("import: stopped crawling after %d pages", maxCrawl)
+	}
+	return pages, nil
+}
+
+// sitePath returns the path of a page for the URL path p.
+func sitePath(p string) string {
+	if p = strings.Trim(p, "/"); p == "" {
+		return "."
+	}
+	return p
+}
+
+// fetchPage fetches the page at u, whose path is p.  It returns nil if
+// the page does not exist.  Pages without a go-import meta tag are fetched
+// a second time with ``?go-get=1'', for servers that only return it then.
+func fetchPage(client *http.Client, u *url.URL, p string) (*crawledPage, error) {
+	get := func(u string) (*http.Response, []byte, error) {
+		resp, err := client.Get(u)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer resp.Body.Close()
+		data, err := ioutil.ReadAll(resp.Body)
+		return resp, data, err
+	}
+	resp, data, err := get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	pg := crawledPage{path: p}
+	switch {
+	case resp.StatusCode >= 300 && resp.StatusCode < 400:
+		pg.redirect = resp.Header.Get("Location")
+	case resp.StatusCode == http.StatusOK:
+		pg, err = parsePage(p, data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", u, err)
+		}
+	default:
+		return nil, nil
+	}
+	if len(pg.imports) == 0 {
+		gu := *u
+		gu.RawQuery = "go-get=1"
+		resp, data, err := get(gu.String())
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusOK {
+			gp, err := parsePage(p, data)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", &gu, err)
+			}
+			pg.imports, pg.source = gp.imports, gp.source
+		}
+	}
+	return &pg, nil
+}
+
+// parsePage parses the HTML document data of the page at path p.
+func parsePage(p string, data []byte) (crawledPage, error) {
+	pg := crawledPage{path: p}
+	var err error
+	pg.imports, err = parseMetaGoImports(bytes.NewReader(data))
+	if err != nil {
+		return pg, err
+	}
+	d := xml.NewDecoder(bytes.NewReader(data))
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+	for {
+		t, err := d.RawToken()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return pg, err
+		}
+		e, ok := t.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch strings.ToLower(e.Name.Local) {
+		case "meta":
+			switch {
+			case attrValue(e.Attr, "name") == "go-source":
+				pg.source = strings.Join(strings.Fields(attrValue(e.Attr, "content")), " ")
+			case strings.EqualFold(attrValue(e.Attr, "http-equiv"), "refresh"):
+				// content="0; url=https://..."
+				c := attrValue(e.Attr, "content")
+				if i := strings.Index(strings.ToLower(c), "url="); i >= 0 {
+					pg.redirect = strings.Trim(strings.TrimSpace(c[i+4:]), `'"`)
+				}
+			}
+		case "a":
+			if href := attrValue(e.Attr, "href"); href != "" {
+				pg.links = append(pg.links, href)
+			}
+		}
+	}
+	return pg, nil
+}
+
+// An importedEntry is an import section of the imported configuration.
+type importedEntry struct {
+	vcs      string
+	repo     string
+	redirect string // with placeholders
+	source   string
+	depth    int // of the page it was taken from
+	pkgs     int // number of pages of the packages below the import
+}
+
+// importConfig returns the configuration equivalent to the crawled pages.
+// The entries are taken from the page of the import itself, if there is
+// one, or else from the page closest to the root of the site.  The imports
+// with pages for the packages below them get ``dirs = true'', so that the
+// pages are generated again from their sources.
+func importConfig(pages []crawledPage) (string, error) {
+	entries := map[string]*importedEntry{}
+	pkgs := map[string]int{}
+	for _, pg := range pages {
+		if len(pg.imports) == 0 {
+			continue
+		}
+		mi := pg.imports[0]
+		for _, m := range pg.imports {
+			if isImportPage(pg.path, m.Prefix) {
+				mi = m
+			}
+		}
+		host := hostOf(mi.Prefix)
+		imprt := path.Join(host, strings.TrimPrefix(pg.path, host+"/"))
+		depth := strings.Count(pg.path, "/")
+		if isImportPage(pg.path, mi.Prefix) {
+			imprt, depth = mi.Prefix, -1
+		} else {
+			pkgs[mi.Prefix]++
+		}
+		if e := entries[mi.Prefix]; e != nil && e.depth <= depth {
+			continue
+		}
+		entries[mi.Prefix] = &importedEntry{
+			vcs:      mi.VCS,
+			repo:     mi.RepoRoot,
+			redirect: placeholder(pg.redirect, imprt),
+			source:   pg.source,
+			depth:    depth,
+		}
+	}
+	if len(entries) == 0 {
+		return "", fmt.Errorf("import: no go-import meta tags found")
+	}
+	for p, n := range pkgs {
+		entries[p].pkgs = n
+	}
+
+	var prefixes []string
+	for p := range entries {
+		prefixes = append(prefixes, p)
+	}
+	sort.Strings(prefixes)
+
+	// The common host and redirection go to the default section.
+	root := hostOf(prefixes[0])
+	redirect := entries[prefixes[0]].redirect
+	same := true
+	for _, p := range prefixes {
+		if hostOf(p) != root || p == root {
+			root = ""
+		}
+		if entries[p].redirect != redirect {
+			same = false
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString("[default]\n")
+	if root != "" {
+		fmt.Fprintf(&sb, "\troot = %s\n", root)
+	}
+	if same {
+		fmt.Fprintf(&sb, "\tredirect = %s\n", quoteValue(redirect))
+	}
+	// The sub-directories have no pages of their own without sources.
+	sb.WriteString("\tdirs = false\n")
+	for _, p := range prefixes {
+		e := entries[p]
+		k := p
+		if root != "" {
+			k = strings.TrimPrefix(p, root+"/")
+		}
+		fmt.Fprintf(&sb, "\n[import %q]\n", k)
+		fmt.Fprintf(&sb, "\trepo = %s\n", quoteValue(escapePlaceholders(e.repo)))
+		if guessVCS(e.repo) != e.vcs {
+			fmt.Fprintf(&sb, "\tvcs = %s\n", e.vcs)
+		}
+		if !same {
+			fmt.Fprintf(&sb, "\tredirect = %s\n", quoteValue(e.redirect))
+		}
+		if e.source != "" {
+			fmt.Fprintf(&sb, "\tmeta = %s\n", quoteValue("go-source "+escapePlaceholders(e.source)))
+		}
+		if e.pkgs > 0 {
+			sb.WriteString("\tdirs = true\n")
+			warnf("import: %s has pages for %d packages below it, which are generated from its sources", p, e.pkgs)
+		}
+	}
+	return sb.String(), nil
+}
+
+// isImportPage reports whether the page at path p is the page of the
+// import prefix, with or without the host in the path.
+func isImportPage(p, prefix string) bool {
+	host, rest := splitHost(prefix)
+	if rest == "" {
+		return p == "." || p == host
+	}
+	return p == rest || strings.HasSuffix(p, "/"+rest)
+}
+
+// hostOf returns the first element of the import path imprt.
+func hostOf(imprt string) string {
+	host, _ := splitHost(imprt)
+	return host
+}
+
+// splitHost splits the import path imprt after its first element.
+func splitHost(imprt string) (host, rest string) {
+	if i := strings.IndexByte(imprt, '/'); i >= 0 {
+		return imprt[:i], imprt[i+1:]
+	}
+	return imprt, ""
+}
+
+// placeholder returns the redirection URL u of the page for the import
+// path imprt, with the import path replaced by the ``*'' placeholder.
+func placeholder(u, imprt string) string {
+	parts := strings.Split(u, imprt)
+	for i := range parts {
+		parts[i] = escapePlaceholders(parts[i])
+	}
+	return strings.Join(parts, "*")
+}
+
+// escapePlaceholders doubles the placeholder characters in s,
+// so that they are taken literally.
+func escapePlaceholders(s string) string {
+	return strings.NewReplacer("*", "**", "$", "$$", "%", "%%").Replace(s)
+}
+
+// quoteValue returns s as a configuration value, quoted if necessary.
+func quoteValue(s string) string {
+	if s != "" && !strings.ContainsAny(s, "#;\"\\") && strings.TrimSpace(s) == s {
+		return s
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
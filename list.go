@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+)
+
+// cmdList runs the list command.
+func cmdList(args []string) {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the mappings as JSON")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		usage()
+	}
+
+	cfg, err := readConfig(cfgfiles)
+	ckConfig(err)
+	pages, failed := collectAll(cfg)
+
+	if *asJSON {
+		data, err := json.MarshalIndent(mappings(pages), "", "\t")
+		ck(err)
+		fmt.Printf("%s\n", data)
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "IMPORT\tVCS\tREPO\tREDIRECT")
+		for _, m := range mappings(pages) {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", m.Import, m.VCS, m.Repo, m.Redirect)
+		}
+		ck(w.Flush())
+	}
+	if failed != nil {
+		os.Exit(exitFailed)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// buckets are the upper bounds of the latency histogram in seconds.
+var buckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+
+// metrics counts the requests of the server.  They are exported
+// in the Prometheus text format.
+type metrics struct {
+	mu       sync.Mutex
+	goget    map[string]int64 // go-get requests by import
+	redirect map[string]int64 // browser requests by import
+	denied   map[string]int64 // requests denied access by import
+	notfound int64
+	latency  []int64 // requests by bucket, the last one is +Inf
+	count    int64
+	sum      float64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		goget:    make(map[string]int64),
+		redirect: make(map[string]int64),
+		denied:   make(map[string]int64),
+		latency:  make([]int64, len(buckets)+1),
+	}
+}
+
+// observe records a request for the import imprt, which is empty
+// if no page was found.  Denied requests are counted apart.
+func (m *metrics) observe(imprt string, goget, denied bool, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case denied:
+		m.denied[imprt]++
+	case imprt == "":
+		m.notfound++
+	case goget:
+		m.goget[imprt]++
+	default:
+		m.redirect[imprt]++
+	}
+	sec := d.Seconds()
+	i := sort.SearchFloat64s(buckets, sec)
+	m.latency[i]++
+	m.count++
+	m.sum += sec
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	writeCounter(w, "govanity_go_get_requests_total", "Number of go-get requests by import path.", m.goget)
+	writeCounter(w, "govanity_redirects_total", "Number of browser requests by import path.", m.redirect)
+	writeCounter(w, "govanity_denied_total", "Number of requests denied access by import path.", m.denied)
+	fmt.Fprintln(w, "# HELP govanity_not_found_total Number of requests for unknown paths.")
+	fmt.Fprintln(w, "# TYPE govanity_not_found_total counter")
+	fmt.Fprintf(w, "govanity_not_found_total %d\n", m.notfound)
+
+	fmt.Fprintln(w, "# HELP govanity_request_duration_seconds Latency of the page requests.")
+	fmt.Fprintln(w, "# TYPE govanity_request_duration_seconds histogram")
+	var n int64
+	for i, b := range buckets {
+		n += m.latency[i]
+		fmt.Fprintf(w, "govanity_request_duration_seconds_bucket{le=\"%g\"} %d\n", b, n)
+	}
+	fmt.Fprintf(w, "govanity_request_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.count)
+	fmt.Fprintf(w, "govanity_request_duration_seconds_sum %g\n", m.sum)
+	fmt.Fprintf(w, "govanity_request_duration_seconds_count %d\n", m.count)
+}
+
+func writeCounter(w io.Writer, name, help string, c map[string]int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", name)
+	imports := make([]string, 0, len(c))
+	for imprt := range c {
+		imports = append(imports, imprt)
+	}
+	sort.Strings(imports)
+	for _, imprt := range imports {
+		fmt.Fprintf(w, "%s{import=%q} %d\n", name, imprt, c[imprt])
+	}
+}
+
+// An accessLog writes one JSON object per request.
+type accessLog struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+type accessEntry struct {
+	Time      time.Time `json:"time"`
+	Remote    string    `json:"remote"`
+	Method    string    `json:"method"`
+	Host      string    `json:"host"`
+	Path      string    `json:"path"`
+	Query     string    `json:"query,omitempty"`
+	Status    int       `json:"status"`
+	Import    string    `json:"import,omitempty"`
+	GoGet     bool      `json:"go_get"`
+	Duration  float64   `json:"duration"`
+	UserAgent string    `json:"user_agent,omitempty"`
+}
+
+func (l *accessLog) log(e accessEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.enc.Encode(e)
+}
+
+// A statusWriter remembers the status code of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
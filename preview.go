@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// cmdPreview runs the preview command.
+func cmdPreview(args []string) {
+	fs := flag.NewFlagSet("preview", flag.ExitOnError)
+	addr := fs.String("addr", "localhost:8080", "serve the output directory on `addr`")
+	fs.Parse(args)
+
+	cfg, err := readConfig(cfgfiles)
+	ckConfig(err)
+	pages, _ := collectAll(cfg)
+
+	ln, err := net.Listen("tcp", *addr)
+	ck(err)
+	base := "http://" + ln.Addr().String()
+	srv := &http.Server{Handler: http.FileServer(htmlDir{http.Dir(*outdir)})}
+	go func() { ck(srv.Serve(ln)) }()
+
+	// Resolve the configured imports and the ones given as arguments.
+	var imports []string
+	for _, p := range pages {
+		imports = append(imports, p.dir)
+	}
+	imports = append(imports, fs.Args()...)
+	results := make([]string, len(imports))
+	parallel(len(imports), func(i int) {
+		mi, err := resolveGoGet(base, pages, imports[i])
+		if err != nil {
+			results[i] = fmt.Sprintf("FAIL %s: %v", imports[i], err)
+		} else {
+			results[i] = fmt.Sprintf("ok   %s -> %s %s (prefix %s)", imports[i], mi.VCS, mi.RepoRoot, mi.Prefix)
+		}
+	})
+	for _, r := range results {
+		fmt.Println(r)
+	}
+
+	fmt.Printf("serving %s on %s\n", *outdir, base)
+	select {}
+}
+
+// resolveGoGet resolves the import path imprt against the pages served
+// at base, like ``go get'' does in module mode: it requests the import
+// path and its parents with ``?go-get=1'', starting with the longest,
+// until a page is found.
+func resolveGoGet(base string, pages []page, imprt string) (metaImport, error) {
+	for q := imprt; strings.Contains(q, "/"); q = path.Dir(q) {
+		resp, err := http.Get(base + "/" + previewPath(pages, q) + "?go-get=1")
+		if err != nil {
+			return metaImport{}, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			continue
+		}
+		imports, err := parseMetaGoImports(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return metaImport{}, fmt.Errorf("%s: %v", q, err)
+		}
+		return matchGoImport(imports, imprt)
+	}
+	return metaImport{}, fmt.Errorf("no page found")
+}
+
+// previewPath returns the path of the page for the import path imprt
+// in the output directory, which need not exist.
+func previewPath(pages []page, imprt string) string {
+	if *layout != "full" {
+		return stripHost(imprt)
+	}
+	for _, p := range pages {
+		if p.e.Root != nil && *p.e.Root != "" && strings.HasPrefix(imprt, *p.e.Root+"/") {
+			return strings.TrimPrefix(imprt, *p.e.Root+"/")
+		}
+	}
+	return imprt
+}
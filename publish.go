@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+)
+
+// contentTypes maps the extensions of the generated files
+// to their content types.  All other files are plain text.
+var contentTypes = map[string]string{
+	".html": "text/html; charset=utf-8",
+	".json": "application/json",
+	".xml":  "application/xml",
+}
+
+func contentType(name string) string {
+	name, _ = uncompressedName(name)
+	if t, ok := contentTypes[path.Ext(name)]; ok {
+		return t
+	}
+	return "text/plain; charset=utf-8"
+}
+
+// A bucket is a location in object storage, which files are copied to
+// and deleted from with the command line tool of the provider.
+type bucket struct {
+	scheme string // s3, gs or az
+	url    string // URL of the prefix, without a trailing slash
+}
+
+// parseBucket parses the -publish URL s.
+func parseBucket(s string) (*bucket, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("publish: %s: missing bucket", s)
+	}
+	p := strings.Trim(u.Path, "/")
+	switch u.Scheme {
+	case "s3", "gs":
+		return &bucket{u.Scheme, strings.TrimSuffix(u.Scheme+"://"+u.Host+"/"+p, "/")}, nil
+	case "az":
+		// az://account/container/prefix
+		if p == "" {
+			return nil, fmt.Errorf("publish: %s: missing container", s)
+		}
+		return &bucket{u.Scheme, "https://" + u.Host + ".blob.core.windows.net/" + p}, nil
+	}
+	return nil, fmt.Errorf("publish: %s: unknown scheme, want s3, gs or az", s)
+}
+
+// copy uploads the file f of the output directory as name,
+// with the Cache-Control header cc.
+func (b *bucket) copy(f, name, cc string) error {
+	dst := b.url + "/" + name
+	ct := contentType(name)
+	_, enc := uncompressedName(name)
+	switch b.scheme {
+	case "s3":
+		args := []string{"s3", "cp", "--only-show-errors", "--content-type", ct, "--cache-control", cc}
+		if enc != "" {
+			args = append(args, "--content-encoding", enc)
+		}
+		return run("aws", append(args, f, dst)...)
+	case "gs":
+		args := []string{"-q", "-h", "Content-Type:" + ct, "-h", "Cache-Control:" + cc}
+		if enc != "" {
+			args = append(args, "-h", "Content-Encoding:"+enc)
+		}
+		return run("gsutil", append(args, "cp", f, dst)...)
+	}
+	args := []string{"copy", "--log-level", "ERROR", "--content-type", ct, "--cache-control", cc}
+	if enc != "" {
+		args = append(args, "--content-encoding", enc)
+	}
+	return run("azcopy", append(args, f, dst)...)
+}
+
+// remove deletes the object name.
+func (b *bucket) remove(name string) error {
+	dst := b.url + "/" + name
+	switch b.scheme {
+	case "s3":
+		return run("aws", "s3", "rm", "--only-show-errors", dst)
+	case "gs":
+		return run("gsutil", "-q", "rm", dst)
+	}
+	return run("azcopy", "remove", "--log-level", "ERROR", dst)
+}
+
+// run runs the command name with args, and returns its output
+// as part of the error if it fails.
+func run(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %v\n%s", name, strings.Join(args, " "), err, out)
+	}
+	return nil
+}
+
+// A publishedFile records a file published by an earlier run.
+type publishedFile struct {
+	Hash         string `json:"hash"`
+	CacheControl string `json:"cacheControl"`
+}
+
+// publish uploads the written files that changed since they were last
+// published to the -publish URL, as recorded in the previous state old,
+// and with prune deletes the ones no longer written.  It records the
+// published files in old.
+func publish(cfg *config, pages []page, old *state, prune bool) error {
+	b, err := parseBucket(*publishURL)
+	if err != nil {
+		return err
+	}
+	if old.Published == nil {
+		old.Published = make(map[string]map[string]publishedFile)
+	}
+	prev := old.Published[b.url]
+	if *force {
+		prev = nil
+	}
+	cur := make(map[string]publishedFile)
+	old.Published[b.url] = cur
+
+	// The pages and badges, and their compressed copies, have the Cache-Control
+	// header of their import, the auxiliary files the one of the default section.
+	cc := make(map[string]string)
+	for _, p := range pages {
+		for _, name := range p.names() {
+			cc[name] = *p.e.CacheControl
+		}
+		cc[p.badgeName()] = *p.e.CacheControl
+	}
+	files := make(map[string]publishedFile, len(written))
+	for name, sum := range written {
+		f := publishedFile{fmt.Sprintf("%x", sum), *cfg.Default.CacheControl}
+		base, _ := uncompressedName(name)
+		if h, ok := cc[base]; ok {
+			f.CacheControl = h
+		}
+		files[name] = f
+	}
+
+	var upload, remove []string
+	for name, f := range files {
+		if prev[name] == f {
+			cur[name] = f
+		} else {
+			upload = append(upload, name)
+		}
+	}
+	for name, f := range prev {
+		if _, ok := files[name]; ok {
+			continue
+		}
+		if prune {
+			remove = append(remove, name)
+		} else {
+			cur[name] = f
+		}
+	}
+	sort.Strings(upload)
+	sort.Strings(remove)
+
+	errs := make([]error, len(upload)+len(remove))
+	parallel(len(errs), func(i int) {
+		if i < len(upload) {
+			name := upload[i]
+			errs[i] = b.copy(outFile(name), name, files[name].CacheControl)
+		} else {
+			errs[i] = b.remove(remove[i-len(upload)])
+		}
+	})
+	failed := false
+	for i, name := range upload {
+		if err := errs[i]; err != nil {
+			log.Print(err)
+			failed = true
+			continue
+		}
+		cur[name] = files[name]
+		logEvent(fileEvent{"uploaded", b.url + "/" + name})
+	}
+	for i, name := range remove {
+		if err := errs[len(upload)+i]; err != nil {
+			log.Print(err)
+			failed = true
+			cur[name] = prev[name]
+			continue
+		}
+		logEvent(fileEvent{"deleted", b.url + "/" + name})
+	}
+	if failed {
+		return fmt.Errorf("publish: failed to publish to %s", b.url)
+	}
+	return nil
+}
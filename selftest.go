@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+)
+
+// cmdSelftest runs the selftest command.
+func cmdSelftest(args []string) {
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	goCmd := fs.String("go", "go", "run the go `command`")
+	fs.Parse(args)
+
+	cfg, err := readConfig(cfgfiles)
+	ckConfig(err)
+	pages, failed := collectAll(cfg)
+
+	// Download the imports themselves, or the ones given as arguments.
+	imports := fs.Args()
+	if len(imports) == 0 {
+		for _, p := range pages {
+			if p.dir == *p.e.imprt {
+				imports = append(imports, p.dir)
+			}
+		}
+	}
+	if !selftest(pages, imports, *goCmd) || failed != nil {
+		os.Exit(exitFailed)
+	}
+}
+
+// selftest serves the output directory and downloads the modules imports
+// with the go command, through a local proxy that answers the requests
+// for the domains of pages from the output directory.  It reports the
+// results and returns whether all downloads succeeded.
+func selftest(pages []page, imports []string, goCmd string) bool {
+	base, stop, err := serveDir(*outdir)
+	ck(err)
+	defer stop()
+
+	px := &selftestProxy{
+		base:  base,
+		pages: pages,
+		hosts: make(map[string]bool),
+		// The requests of a proxy already have the absolute URL.
+		forward: &httputil.ReverseProxy{Director: func(*http.Request) {}},
+	}
+	for _, p := range pages {
+		px.hosts[hostOf(p.dir)] = true
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	ck(err)
+	srv := &http.Server{Handler: px}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	tmp, err := ioutil.TempDir("", "govanity-selftest")
+	ck(err)
+	defer os.RemoveAll(tmp)
+
+	// The go command asks the proxy for https first, which fails for the
+	// domains of the pages, and then for http, as they are insecure.
+	hosts := make([]string, 0, len(px.hosts))
+	for h := range px.hosts {
+		hosts = append(hosts, h)
+	}
+	proxy := "http://" + ln.Addr().String()
+	env := append(os.Environ(),
+		"GOPATH="+tmp,
+		"GOMODCACHE=",
+		"GOFLAGS=-modcacherw",
+		"GO111MODULE=on",
+		"GOPROXY=direct",
+		"GOPRIVATE="+strings.Join(hosts, ","),
+		"GOINSECURE="+strings.Join(hosts, ","),
+		"HTTP_PROXY="+proxy, "http_proxy="+proxy,
+		"HTTPS_PROXY="+proxy, "https_proxy="+proxy,
+		"NO_PROXY=", "no_proxy=",
+		"GIT_TERMINAL_PROMPT=0",
+	)
+
+	notes := make([]string, len(imports))
+	errs := make([]error, len(imports))
+	parallel(len(imports), func(i int) {
+		notes[i], errs[i] = download(goCmd, tmp, env, imports[i])
+	})
+
+	ok := true
+	for i, imprt := range imports {
+		if errs[i] != nil {
+			ok = false
+			fmt.Printf("FAIL %s: %v\n", imprt, errs[i])
+		} else {
+			fmt.Printf("ok   %s (%s)\n", imprt, notes[i])
+		}
+	}
+	return ok
+}
+
+// download downloads the latest version of the module imprt with
+// ``go mod download'' in the directory dir and returns the version.
+func download(goCmd, dir string, env []string, imprt string) (string, error) {
+	cmd := exec.Command(goCmd, "mod", "download", "-json", imprt+"@latest")
+	cmd.Dir = dir
+	cmd.Env = env
+	out, err := cmd.Output()
+	var m struct {
+		Version string
+		Error   string
+	}
+	if json.Unmarshal(out, &m) == nil && m.Error != "" {
+		return "", errors.New(m.Error)
+	}
+	if ee, ok := err.(*exec.ExitError); ok {
+		return "", fmt.Errorf("%v: %s", err, bytes.TrimSpace(ee.Stderr))
+	} else if err != nil {
+		return "", err
+	}
+	return m.Version, nil
+}
+
+// A selftestProxy is an HTTP proxy for the go command.  It answers the
+// requests for the domains of the pages from the output directory served
+// at base, refuses to tunnel connections to them, so that the go command
+// falls back to http, and forwards all other requests and connections.
+type selftestProxy struct {
+	base    string
+	pages   []page
+	hosts   map[string]bool
+	forward *httputil.ReverseProxy
+}
+
+func (px *selftestProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		host, _, _ := net.SplitHostPort(r.Host)
+		if px.hosts[host] {
+			http.Error(w, "not tunneled", http.StatusBadGateway)
+			return
+		}
+		tunnel(w, r)
+		return
+	}
+	if !px.hosts[r.URL.Hostname()] {
+		px.forward.ServeHTTP(w, r)
+		return
+	}
+	imprt := r.URL.Hostname() + path.Clean("/"+r.URL.Path)
+	imprt = strings.TrimSuffix(imprt, "/")
+	u := px.base + "/" + previewPath(px.pages, imprt)
+	if r.URL.RawQuery != "" {
+		u += "?" + r.URL.RawQuery
+	}
+	resp, err := http.Get(u)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// tunnel connects the client of the CONNECT request r to its host.
+func tunnel(w http.ResponseWriter, r *http.Request) {
+	dst, err := net.DialTimeout("tcp", r.Host, 10*time.Second)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		dst.Close()
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	src, _, err := hj.Hijack()
+	if err != nil {
+		dst.Close()
+		return
+	}
+	io.WriteString(src, "HTTP/1.1 200 Connection established\r\n\r\n")
+	go func() {
+		io.Copy(dst, src)
+		dst.Close()
+	}()
+	io.Copy(src, dst)
+	src.Close()
+}
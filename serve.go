@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// reloadInterval is the interval in which the configuration files
+// are checked for changes.
+const reloadInterval = 2 * time.Second
+
+// A site holds the rendered pages.
+type site struct {
+	pages map[string]rendered // pages by import path
+	hosts map[string]bool     // domains of the imports
+	host  string              // the only domain, if there is just one
+	files []string            // template files used by the pages
+}
+
+// A rendered page.
+type rendered struct {
+	imprt string
+	data  []byte // for browsers
+	goget []byte // for the go tool
+	badge []byte // nil if there is no badge
+
+	cacheControl string
+	etag         bool
+	browse       string // URL template for browsing, if enabled
+	access       *access
+}
+
+// loadSite reads the configuration files c and renders all pages.
+func loadSite(c cfgFiles) (*site, error) {
+	cfg, err := readConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	pages, err := collect(cfg, nil)
+	if err != nil {
+		return nil, err
+	}
+	s := &site{
+		pages: make(map[string]rendered, len(pages)),
+		hosts: make(map[string]bool),
+	}
+	for _, p := range pages {
+		data, err := render(p, false)
+		if err != nil {
+			return nil, err
+		}
+		goget, err := render(p, true)
+		if err != nil {
+			return nil, err
+		}
+		var badge []byte
+		if *p.e.Badge {
+			badge, err = renderBadge(p)
+			if err != nil {
+				return nil, err
+			}
+		}
+		s.pages[p.dir] = rendered{p.dir, data, goget, badge, *p.e.CacheControl, *p.e.ETag, p.e.browse, p.e.access}
+		s.hosts[hostOf(p.dir)] = true
+	}
+	for f := range cfg.templates {
+		s.files = append(s.files, f)
+	}
+	if len(s.hosts) == 1 {
+		for h := range s.hosts {
+			s.host = h
+		}
+	}
+	return s, nil
+}
+
+// A server serves the current site.  The site is replaced
+// atomically, so requests in flight are answered from the old one.
+type server struct {
+	site    atomic.Value
+	metrics *metrics
+	log     *accessLog // nil if there is no access log
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cur, _ := s.site.Load().(*site)
+	if cur == nil {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+
+	start := time.Now()
+	sw := &statusWriter{w, http.StatusOK}
+	goget := r.FormValue("go-get") == "1"
+	imprt, denied := cur.serve(sw, r, goget)
+	d := time.Since(start)
+	s.metrics.observe(imprt, goget, denied, d)
+	if s.log != nil {
+		s.log.log(accessEntry{
+			Time:      start,
+			Remote:    r.RemoteAddr,
+			Method:    r.Method,
+			Host:      r.Host,
+			Path:      r.URL.Path,
+			Query:     r.URL.RawQuery,
+			Status:    sw.status,
+			Import:    imprt,
+			GoGet:     goget,
+			Duration:  d.Seconds(),
+			UserAgent: r.UserAgent(),
+		})
+	}
+}
+
+// serveAdmin answers the requests to the -metrics address.  They are
+// kept apart from the pages, so that any import path can be served.
+func (s *server) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	cur, _ := s.site.Load().(*site)
+	switch r.URL.Path {
+	case "/healthz":
+		fmt.Fprintln(w, "ok")
+	case "/readyz", "/metrics":
+		if cur == nil {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		if r.URL.Path == "/metrics" {
+			s.metrics.ServeHTTP(w, r)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serve answers r with the matching page and returns its import path,
+// or the empty string if there is none, and whether the request was
+// denied by the access restrictions of the page.  The page is looked up by the
+// host of the request and its path; if the site has a single domain,
+// requests for other hosts, e.g. behind a reverse proxy, are answered
+// as if for that domain.
+func (cur *site) serve(w http.ResponseWriter, r *http.Request, goget bool) (string, bool) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	if !cur.hosts[host] && cur.host != "" {
+		host = cur.host
+	}
+	p := host
+	if rest := strings.Trim(r.URL.Path, "/"); rest != "" {
+		p += "/" + rest
+	}
+	if strings.HasSuffix(p, "/badge.json") {
+		pg, ok := cur.pages[strings.TrimSuffix(p, "/badge.json")]
+		if !ok || pg.badge == nil {
+			http.NotFound(w, r)
+			return "", false
+		}
+		if !pg.access.allowed(r) {
+			pg.access.deny(w, r)
+			return pg.imprt, true
+		}
+		pg.write(w, r, "application/json", pg.badge)
+		return pg.imprt, false
+	}
+	pg, ok := cur.pages[p]
+	if !ok && !goget {
+		var u string
+		splitBrowse(p, func(prefix, kind, rest string) bool {
+			if bp, ok := cur.pages[prefix]; ok && bp.browse != "" {
+				pg, u = bp, browseURL(bp.browse, kind, rest)
+				return true
+			}
+			return false
+		})
+		if u != "" && !pg.access.allowed(r) {
+			pg.access.deny(w, r)
+			return pg.imprt, true
+		}
+		if u != "" {
+			http.Redirect(w, r, u, http.StatusFound)
+			return pg.imprt, false
+		}
+	}
+	if !ok && goget {
+		// The go tool also asks for the packages below an import,
+		// which are answered by the page of the import.
+		for q := p; !ok && strings.Contains(q, "/"); {
+			q = path.Dir(q)
+			pg, ok = cur.pages[q]
+		}
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return "", false
+	}
+	if !pg.access.allowed(r) {
+		pg.access.deny(w, r)
+		return pg.imprt, true
+	}
+	if goget {
+		pg.write(w, r, "text/html; charset=utf-8", pg.goget)
+	} else {
+		pg.write(w, r, "text/html; charset=utf-8", pg.data)
+	}
+	return pg.imprt, false
+}
+
+// write answers r with data, setting the caching headers of pg.
+// Conditional requests are answered with 304 Not Modified.
+func (pg rendered) write(w http.ResponseWriter, r *http.Request, contentType string, data []byte) {
+	h := w.Header()
+	h.Set("Content-Type", contentType)
+	if pg.access != nil {
+		h.Set("Cache-Control", "private")
+	} else if pg.cacheControl != "" {
+		h.Set("Cache-Control", pg.cacheControl)
+	}
+	if pg.etag {
+		sum := sha256.Sum256(data)
+		h.Set("ETag", fmt.Sprintf(`"%x"`, sum[:16]))
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+// reload loads the site from the configuration files.  On failure,
+// the current site is kept.
+func (s *server) reload() error {
+	site, err := loadSite(cfgfiles)
+	if err != nil {
+		return err
+	}
+	s.site.Store(site)
+	if *verbose {
+		log.Printf("loaded %s: %d pages", &cfgfiles, len(site.pages))
+	}
+	return nil
+}
+
+// hostPolicy allows certificates only for the domains of the current site.
+func (s *server) hostPolicy(ctx context.Context, host string) error {
+	cur, _ := s.site.Load().(*site)
+	if cur == nil || !cur.hosts[host] {
+		return fmt.Errorf("host %q not configured", host)
+	}
+	return nil
+}
+
+// serve serves the pages on the -http or -https address.  The configuration
+// is reloaded on SIGHUP and whenever one of the configuration files changes.
+func serve() {
+	s := &server{metrics: newMetrics()}
+	if *accesslog != "" {
+		w := os.Stdout
+		if *accesslog != "-" {
+			f, err := os.OpenFile(*accesslog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+			ck(err)
+			defer f.Close()
+			w = f
+		}
+		s.log = &accessLog{enc: json.NewEncoder(w)}
+	}
+	var srvs []*http.Server
+	if *httpsAddr == "" {
+		srvs = append(srvs, &http.Server{Addr: *httpAddr, Handler: s})
+	} else {
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(*certcache),
+			HostPolicy: s.hostPolicy,
+		}
+		srvs = append(srvs, &http.Server{Addr: *httpsAddr, Handler: s, TLSConfig: m.TLSConfig()})
+		if *httpAddr != "" {
+			// Answer HTTP-01 challenges and redirect everything else to HTTPS.
+			srvs = append(srvs, &http.Server{Addr: *httpAddr, Handler: m.HTTPHandler(nil)})
+		}
+	}
+	if *adminAddr != "" {
+		srvs = append(srvs, &http.Server{Addr: *adminAddr, Handler: http.HandlerFunc(s.serveAdmin)})
+	}
+
+	go func() {
+		err := s.reload()
+		ck(err)
+		mtime := s.modTime()
+
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		tick := time.NewTicker(reloadInterval)
+		for {
+			select {
+			case <-hup:
+			case <-tick.C:
+				t := s.modTime()
+				if t.Equal(mtime) {
+					continue
+				}
+				mtime = t
+			}
+			err := s.reload()
+			if err != nil {
+				log.Printf("reload: %v", err)
+			}
+		}
+	}()
+
+	go func() {
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		<-stop
+		for _, srv := range srvs {
+			srv.Shutdown(context.Background())
+		}
+	}()
+
+	errc := make(chan error, len(srvs))
+	for _, srv := range srvs {
+		go func(srv *http.Server) {
+			if srv.TLSConfig != nil {
+				errc <- srv.ListenAndServeTLS("", "")
+			} else {
+				errc <- srv.ListenAndServe()
+			}
+		}(srv)
+	}
+	for range srvs {
+		err := <-errc
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}
+}
+
+// modTime returns the latest modification time of the configuration
+// files, including the directories, so that added and removed files
+// are noticed as well, and of the template files of the current site.
+func (s *server) modTime() time.Time {
+	files, _ := cfgfiles.files()
+	files = append(files, cfgfiles...)
+	if cur, _ := s.site.Load().(*site); cur != nil {
+		files = append(files, cur.files...)
+	}
+	var t time.Time
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err == nil && fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+	return t
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"go/build"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// srcDirs are the source directories given with -srcdir.  Each is
+// either a directory containing the imports by import path, like the
+// src directory of a GOPATH, or ``import=dir'' for a checkout of a
+// single import.
+type srcDirs []string
+
+var srcdirs srcDirs
+
+func (s *srcDirs) String() string {
+	return strings.Join(*s, string(filepath.ListSeparator))
+}
+
+func (s *srcDirs) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// srcDir returns the directory of the import path imprt: in the first
+// -srcdir containing it, or else in the first GOPATH entry containing it.
+// If there is none, it returns the directory in the first candidate, so
+// that walking it reports the missing directory.
+func srcDir(imprt string) string {
+	var dirs []string
+	for _, s := range srcdirs {
+		if i := strings.IndexByte(s, '='); i >= 0 {
+			prefix, dir := s[:i], s[i+1:]
+			if imprt == prefix {
+				dirs = append(dirs, dir)
+			} else if strings.HasPrefix(imprt, prefix+"/") {
+				dirs = append(dirs, filepath.Join(dir, filepath.FromSlash(imprt[len(prefix)+1:])))
+			}
+			continue
+		}
+		dirs = append(dirs, filepath.Join(s, filepath.FromSlash(imprt)))
+	}
+	for _, gp := range filepath.SplitList(build.Default.GOPATH) {
+		dirs = append(dirs, filepath.Join(gp, "src", filepath.FromSlash(imprt)))
+	}
+	if len(dirs) == 0 {
+		return filepath.Join("src", filepath.FromSlash(imprt))
+	}
+	for _, d := range dirs {
+		if fi, err := os.Stat(d); err == nil && fi.IsDir() {
+			return d
+		}
+	}
+	return dirs[0]
+}
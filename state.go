@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// stateFile is the name of the state file in the output directory.
+const stateFile = ".govanity-state"
+
+// A state records the result of a run, so that the next run can skip
+// the imports that did not change and delete the files no longer generated.
+type state struct {
+	Config  string                 `json:"config"`  // hash of the configuration
+	Entries map[string]*entryState `json:"entries"` // by import prefix
+	Files   map[string]string      `json:"files"`   // hashes of all written files
+
+	// Published maps the -publish URLs to the files published there.
+	Published map[string]map[string]publishedFile `json:"published,omitempty"`
+}
+
+type entryState struct {
+	Hash  string      `json:"hash"` // hash of the resolved entry
+	Pages []pageState `json:"pages"`
+}
+
+type pageState struct {
+	Import   string `json:"import"`
+	Redirect string `json:"redirect,omitempty"`
+	Hash     string `json:"hash"`
+}
+
+// readState reads the state file of the output directory.  It returns
+// an empty state if there is none or it cannot be read.
+func readState() *state {
+	st := new(state)
+	data, err := ioutil.ReadFile(filepath.Join(*outdir, stateFile))
+	if err == nil {
+		err = json.Unmarshal(data, st)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		warnf("ignoring %s: %v", stateFile, err)
+		st = new(state)
+	}
+	return st
+}
+
+// configHash returns the hash of the global parts of the configuration cfg,
+// including the -layout flag.  The imports are covered by the hashes of
+// their entries, which include the defaults, profiles and source directories.
+func configHash(cfg *config) string {
+	data, err := json.Marshal(struct {
+		Pages     pagesConfig
+		Workspace workspaceConfig
+		Layout    string
+	}{cfg.Pages, cfg.Workspace, *layout})
+	ck(err)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// entryHash returns the hash of the resolved entry e, including its
+// noredirect-template, its source directory src and the configured
+// imports nested below it, whose directories it leaves to them.
+func entryHash(e *entry, src string, nested []string) string {
+	data, err := json.Marshal(struct {
+		Import   string
+		Template string
+		Src      string
+		Nested   []string
+		*entry
+	}{*e.imprt, e.noRedirectSrc, src, nested, e})
+	ck(err)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// pages returns the pages of the import e recorded in st, or nil if the
+// hash of e changed since then or any of its files is missing or was
+// modified.
+func (st *state) pages(cfg *config, e *entry) []page {
+	if st.Config != configHash(cfg) {
+		return nil
+	}
+	es := st.Entries[*e.imprt]
+	if es == nil || es.Hash != e.hash {
+		return nil
+	}
+	var pages []page
+	for _, ps := range es.Pages {
+		p := page{dir: ps.Import, e: *e, cached: true}
+		if ps.Redirect != "" {
+			redirect := ps.Redirect
+			p.e.Redirect = &redirect
+		}
+		for _, name := range p.names() {
+			data, err := ioutil.ReadFile(outFile(name))
+			if err != nil {
+				return nil
+			}
+			p.sum = sha256.Sum256(data)
+			if hex.EncodeToString(p.sum[:]) != ps.Hash {
+				return nil
+			}
+		}
+		pages = append(pages, p)
+	}
+	return pages
+}
+
+// writeState records the generated pages and all written files
+// in the state file, and the published files of the previous state old.
+// The failed imports keep their entries of old, and all files of old stay
+// recorded, so that a later run can still prune them.
+func writeState(cfg *config, pages []page, old *state, failed entryErrors) error {
+	st := &state{
+		Config:    configHash(cfg),
+		Entries:   make(map[string]*entryState),
+		Files:     make(map[string]string),
+		Published: old.Published,
+	}
+	for _, p := range pages {
+		es := st.Entries[*p.e.imprt]
+		if es == nil {
+			es = &entryState{Hash: p.e.hash}
+			st.Entries[*p.e.imprt] = es
+		}
+		ps := pageState{Import: p.dir}
+		if p.e.Redirect != nil {
+			ps.Redirect = *p.e.Redirect
+		}
+		sum := written[p.name()]
+		ps.Hash = hex.EncodeToString(sum[:])
+		es.Pages = append(es.Pages, ps)
+	}
+	for name, sum := range written {
+		st.Files[name] = hex.EncodeToString(sum[:])
+	}
+	if failed != nil {
+		for imprt := range failed.imports() {
+			if es := old.Entries[imprt]; es != nil {
+				st.Entries[imprt] = es
+			} else {
+				delete(st.Entries, imprt)
+			}
+		}
+		for name, h := range old.Files {
+			if _, ok := st.Files[name]; !ok {
+				st.Files[name] = h
+			}
+		}
+	}
+	data, err := json.MarshalIndent(st, "", "\t")
+	if err != nil {
+		return err
+	}
+	// Without any written file, the output directory may not exist yet.
+	err = os.MkdirAll(*outdir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(*outdir, stateFile), append(data, '\n'), 0666)
+}
+
+// prune deletes the files recorded in the previous state old that were
+// not written in this run, and the directories left empty by them.
+func prune(old *state) error {
+	var names []string
+	for name := range old.Files {
+		if _, ok := written[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := outFile(name)
+		if *diff {
+			if _, err := os.Stat(f); err == nil {
+				logEvent(fileEvent{"deleted", f})
+			}
+			continue
+		}
+		err := os.Remove(f)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		logEvent(fileEvent{"deleted", f})
+		for d := path.Dir(name); d != "."; d = path.Dir(d) {
+			if os.Remove(outFile(d)) != nil {
+				break
+			}
+		}
+	}
+	return nil
+}
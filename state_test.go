@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// generateDirs generates the pages of the configuration text into the
+// output directory like a run with the state st, records the state and
+// returns the import paths of the pages.
+func generateDirs(t *testing.T, dir, text string, st *state) []string {
+	t.Helper()
+	f := filepath.Join(dir, "govanity.cfg")
+	err := ioutil.WriteFile(f, []byte(text), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := readConfig(cfgFiles{f})
+	if err != nil {
+		t.Fatal(err)
+	}
+	written = map[string][sha256.Size]byte{}
+	pages, err := collect(cfg, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed := govanity(pages); failed != nil {
+		t.Fatal(failed)
+	}
+	err = writeState(cfg, pages, new(state), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dirs []string
+	for _, p := range pages {
+		dirs = append(dirs, p.dir)
+	}
+	return dirs
+}
+
+// setupState sets the flags for generating into a temporary directory and
+// returns it.
+func setupState(t *testing.T) string {
+	dir := t.TempDir()
+	oldOutdir, oldSrcdirs, oldQuiet := *outdir, srcdirs, *quiet
+	t.Cleanup(func() {
+		*outdir, srcdirs, *quiet = oldOutdir, oldSrcdirs, oldQuiet
+	})
+	*outdir = filepath.Join(dir, "out")
+	*quiet = true
+	return dir
+}
+
+func writeModule(t *testing.T, dir, mod string, pkgs ...string) {
+	t.Helper()
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(dir, "go.mod"), []byte("module "+mod+"\n"), 0666)
+	}
+	for _, pkg := range pkgs {
+		if err == nil {
+			err = os.MkdirAll(filepath.Join(dir, pkg), os.ModePerm)
+		}
+		if err == nil {
+			src := "package " + filepath.Base(pkg) + "\n"
+			err = ioutil.WriteFile(filepath.Join(dir, pkg, "x.go"), []byte(src), 0666)
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStateNestedImport(t *testing.T) {
+	dir := setupState(t)
+	writeModule(t, filepath.Join(dir, "a"), "example.com/a", "b")
+	srcdirs = srcDirs{"example.com/a=" + filepath.Join(dir, "a")}
+
+	const a = `
+[default]
+	root = example.com
+	repo = https://github.com/example/$
+[import "a"]
+`
+	got := generateDirs(t, dir, a+`[import "a/b"]`+"\n", nil)
+	want := []string{"example.com/a", "example.com/a/b"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("with a/b: pages %q, want %q", got, want)
+	}
+
+	// Without its own import, a/b is a directory of a.
+	got = generateDirs(t, dir, a, readState())
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("without a/b: pages %q, want %q", got, want)
+	}
+}
+
+func TestStateSrcDir(t *testing.T) {
+	dir := setupState(t)
+	writeModule(t, filepath.Join(dir, "old"), "example.com/a")
+	writeModule(t, filepath.Join(dir, "new"), "example.com/a", "b")
+
+	const a = `
+[default]
+	root = example.com
+	repo = https://github.com/example/$
+[import "a"]
+`
+	srcdirs = srcDirs{"example.com/a=" + filepath.Join(dir, "old")}
+	got := generateDirs(t, dir, a, nil)
+	want := []string{"example.com/a"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("old: pages %q, want %q", got, want)
+	}
+
+	srcdirs = srcDirs{"example.com/a=" + filepath.Join(dir, "new")}
+	got = generateDirs(t, dir, a, readState())
+	want = []string{"example.com/a", "example.com/a/b"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("new: pages %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// vcsSchemes are the URL schemes the go tool accepts for the
+// repositories of each supported version control system.
+var vcsSchemes = map[string][]string{
+	"bzr":    {"https", "http", "bzr", "bzr+ssh"},
+	"fossil": {"https", "http"},
+	"git":    {"https", "http", "git", "git+ssh", "ssh"},
+	"hg":     {"https", "http", "ssh"},
+	"svn":    {"https", "http", "svn", "svn+ssh"},
+}
+
+// vcsHosts are hosts that only serve repositories of one system.
+var vcsHosts = map[string]string{
+	"bitbucket.org":      "git",
+	"code.launchpad.net": "bzr",
+	"foss.heptapod.net":  "hg",
+	"github.com":         "git",
+	"gitlab.com":         "git",
+	"launchpad.net":      "bzr",
+}
+
+// guessVCS returns the version control system of the repository repo,
+// judging by its suffix (e.g. ``.hg''), its host, or a host name prefix
+// (e.g. ``hg.example.com'').  It defaults to git.
+func guessVCS(repo string) string {
+	u, err := url.Parse(repo)
+	if err != nil {
+		return "git"
+	}
+	for vcs := range vcsSchemes {
+		if strings.HasSuffix(u.Path, "."+vcs) {
+			return vcs
+		}
+	}
+	host := u.Hostname()
+	if vcs, ok := vcsHosts[host]; ok {
+		return vcs
+	}
+	if i := strings.IndexByte(host, '.'); i >= 0 {
+		if _, ok := vcsSchemes[host[:i]]; ok {
+			return host[:i]
+		}
+	}
+	return "git"
+}
+
+// checkVCS checks that the go tool supports the version control
+// system vcs and can fetch the repository repo with it.
+func checkVCS(vcs, repo string) error {
+	schemes, ok := vcsSchemes[vcs]
+	if !ok {
+		var names []string
+		for name := range vcsSchemes {
+			names = append(names, name)
+			if sortedLetters(name) == sortedLetters(vcs) {
+				return fmt.Errorf("unknown vcs %q, did you mean %q?", vcs, name)
+			}
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown vcs %q, must be one of %s", vcs, strings.Join(names, ", "))
+	}
+
+	u, err := url.Parse(repo)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("repo %q is not a URL with scheme and host", repo)
+	}
+	for _, s := range schemes {
+		if u.Scheme == s {
+			return nil
+		}
+	}
+	return fmt.Errorf("repo %q: scheme %s is not supported for %s, must be one of %s",
+		repo, u.Scheme, vcs, strings.Join(schemes, ", "))
+}
+
+// sortedLetters returns the letters of s in sorted order.
+func sortedLetters(s string) string {
+	b := []byte(s)
+	sort.Slice(b, func(i, j int) bool { return b[i] < b[j] })
+	return string(b)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// serveDir serves the directory dir on a local port and returns its
+// base URL and a function to stop the server.
+func serveDir(dir string) (string, func(), error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+	srv := &http.Server{Handler: http.FileServer(htmlDir{http.Dir(dir)})}
+	go srv.Serve(ln)
+	return "http://" + ln.Addr().String(), func() { srv.Close() }, nil
+}
+
+// An htmlDir serves the files of a directory like static hosts do,
+// which serve the file ``x.html'' for the path ``/x'' if there is no ``x''.
+type htmlDir struct {
+	http.Dir
+}
+
+func (d htmlDir) Open(name string) (http.File, error) {
+	f, err := d.Dir.Open(name)
+	if os.IsNotExist(err) && path.Ext(name) == "" {
+		if hf, herr := d.Dir.Open(name + ".html"); herr == nil {
+			return hf, nil
+		}
+	}
+	return f, err
+}
+
+// cmdVerify runs the verify command.
+func cmdVerify(args []string) {
+	if len(args) != 0 {
+		usage()
+	}
+	cfg, err := readConfig(cfgfiles)
+	ckConfig(err)
+	pages, failed := collectAll(cfg)
+	if !verify(pages) || failed != nil {
+		os.Exit(exitFailed)
+	}
+}
+
+// verify checks the pages in the output directory.  It serves them locally,
+// resolves every page like the go tool does and compares the result with the
+// configuration.  For the imports themselves, it additionally checks that the
+// go.mod file of the repository declares the import path as module path.
+// It reports the results and returns whether all checks passed.
+func verify(pages []page) bool {
+	base, stop, err := serveDir(*outdir)
+	ck(err)
+	defer stop()
+
+	notes := make([]string, len(pages))
+	errs := make([]error, len(pages))
+	parallel(len(pages), func(i int) {
+		notes[i], errs[i] = verifyPage(base, pages[i])
+	})
+
+	ok := true
+	for i, p := range pages {
+		switch {
+		case errs[i] != nil:
+			ok = false
+			fmt.Printf("FAIL %s: %v\n", p.dir, errs[i])
+		case notes[i] != "":
+			fmt.Printf("ok   %s (%s)\n", p.dir, notes[i])
+		default:
+			fmt.Printf("ok   %s\n", p.dir)
+		}
+	}
+	return ok
+}
+
+// verifyPage checks the page p, served at base.  If the check
+// passes, it returns an optional note about it.
+func verifyPage(base string, p page) (string, error) {
+	resp, err := http.Get(base + "/" + p.path() + "?go-get=1")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", p.name(), resp.Status)
+	}
+	imports, err := parseMetaGoImports(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", p.name(), err)
+	}
+	mi, err := matchGoImport(imports, p.dir)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", p.name(), err)
+	}
+	want := metaImport{*p.e.imprt, *p.e.VCS, *p.e.Repo}
+	if mi != want {
+		return "", fmt.Errorf("%s: meta tag is %q, config says %q", p.name(), mi, want)
+	}
+
+	if p.dir != *p.e.imprt {
+		return "", nil
+	}
+	if mi.VCS != "git" {
+		return "go.mod not checked for vcs " + mi.VCS, nil
+	}
+	ref := ""
+	if p.e.Ref != nil {
+		ref = *p.e.Ref
+	}
+	dir, err := clone(mi.RepoRoot, ref)
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "go.mod"))
+	if os.IsNotExist(err) {
+		return "no go.mod", nil
+	} else if err != nil {
+		return "", err
+	}
+	if mod := modulePath(data); mod != p.dir {
+		return "", fmt.Errorf("meta tag says %s, but go.mod declares module %s", p.dir, mod)
+	}
+	return "", nil
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// A vetError is a problem in a configuration file.
+type vetError struct {
+	file    string
+	line    int
+	section string
+	msg     string
+}
+
+func (e *vetError) Error() string {
+	if e.section == "" {
+		return fmt.Sprintf("%s:%d: %s", e.file, e.line, e.msg)
+	}
+	return fmt.Sprintf("%s:%d: [%s]: %s", e.file, e.line, e.section, e.msg)
+}
+
+// A vetErrors is the list of problems found in the configuration files.
+type vetErrors []error
+
+func (errs vetErrors) Error() string {
+	s := make([]string, len(errs))
+	for i, err := range errs {
+		s[i] = err.Error()
+	}
+	return strings.Join(s, "\n")
+}
+
+// noPlaceholders are the variables that do not support placeholders.
+var noPlaceholders = map[string]bool{
+	"profile":             true,
+	"root":                true,
+	"vcs":                 true,
+	"dirs":                true,
+	"ref":                 true,
+	"nested":              true,
+	"filename":            true,
+	"browse-url":          true,
+	"noredirect-template": true,
+}
+
+// vetFiles checks the configuration files files.  It reports unknown
+// sections and variables, empty roots, import paths with leading or
+// trailing slashes, sections defined twice in the same file, which gcfg
+// would merge silently, misused placeholders and references to profiles
+// that are not defined in any of the files.
+func vetFiles(files []string) []error {
+	var errs []error
+	profiles := make(map[string]bool)
+	var refs []profileRef
+	for _, f := range files {
+		var data []byte
+		var err error
+		name := f
+		if f == "-" {
+			data, name = stdin, "stdin"
+		} else if data, err = ioutil.ReadFile(f); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		ferrs, frefs := vet(name, data, profiles)
+		errs = append(errs, ferrs...)
+		refs = append(refs, frefs...)
+	}
+	for _, r := range refs {
+		if !profiles[r.name] {
+			errs = append(errs, &vetError{r.file, r.line, r.section, fmt.Sprintf("unknown profile %q", r.name)})
+		}
+	}
+	return errs
+}
+
+// A profileRef is a ``profile'' entry, which can refer to a profile
+// section of a later file.
+type profileRef struct {
+	file    string
+	line    int
+	section string
+	name    string
+}
+
+// vet checks the configuration file f with the contents data.  It adds
+// the names of its profile sections to profiles and returns the profile
+// references to be checked against them after all files.
+func vet(f string, data []byte, profiles map[string]bool) ([]error, []profileRef) {
+	sections := configSections()
+	var errs []error
+	errorf := func(line int, section, format string, args ...interface{}) {
+		errs = append(errs, &vetError{f, line, section, fmt.Sprintf(format, args...)})
+	}
+
+	var refs []profileRef
+	seen := make(map[string]int)
+	var vars map[string]bool
+	var section, sectionName string
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	line := 0
+	for sc.Scan() {
+		line++
+		n := line
+		l := strings.TrimSpace(sc.Text())
+		// Join continuation lines.
+		for strings.HasSuffix(l, "\\") && !strings.HasSuffix(l, "\\\\") && sc.Scan() {
+			line++
+			l = l[:len(l)-1] + strings.TrimSpace(sc.Text())
+		}
+		if l == "" || l[0] == ';' || l[0] == '#' {
+			continue
+		}
+
+		if l[0] == '[' {
+			end := strings.LastIndexByte(l, ']')
+			if end < 0 {
+				errorf(n, "", "missing ] in section header")
+				vars = nil
+				continue
+			}
+			hdr := strings.TrimSpace(l[1:end])
+			sectionName = hdr
+			name, sub, hasSub := hdr, "", false
+			if i := strings.IndexAny(hdr, " \t"); i >= 0 {
+				name, sub, hasSub = hdr[:i], unquote(hdr[i:]), true
+			}
+			section = strings.ToLower(name)
+			if hasSub {
+				sectionName = fmt.Sprintf("%s %q", section, sub)
+			}
+			info, ok := sections[section]
+			switch {
+			case !ok:
+				errorf(n, "", "unknown section %q", name)
+				vars = nil
+				continue
+			case info.sub && !hasSub:
+				errorf(n, sectionName, "missing name, e.g. [%s \"path\"]", section)
+			case !info.sub && hasSub:
+				errorf(n, sectionName, "section %s takes no name", section)
+			}
+			vars = info.vars
+			if prev, ok := seen[sectionName]; ok {
+				errorf(n, sectionName, "section defined twice (previously at line %d)", prev)
+			} else {
+				seen[sectionName] = n
+			}
+			if section == "import" && sub != strings.Trim(sub, "/") {
+				errorf(n, sectionName, "import path has a leading or trailing slash")
+			}
+			if section == "profile" && hasSub {
+				profiles[sub] = true
+			}
+			continue
+		}
+
+		if vars == nil {
+			if section == "" {
+				errorf(n, "", "variable outside of a section")
+			}
+			continue
+		}
+		name, value := l, ""
+		if i := strings.IndexByte(l, '='); i >= 0 {
+			name, value = strings.TrimSpace(l[:i]), unquote(l[i+1:])
+		}
+		key := strings.ToLower(strings.Replace(name, "_", "-", -1))
+		if !vars[key] {
+			errorf(n, sectionName, "unknown variable %q", name)
+			continue
+		}
+		if section == "profile" && key == "profile" {
+			errorf(n, sectionName, "profiles cannot have a profile")
+		} else if key == "profile" && value != "" {
+			refs = append(refs, profileRef{f, n, sectionName, value})
+		}
+		if key == "root" && value == "" {
+			errorf(n, sectionName, "root is empty")
+		}
+		if key == "head" {
+			// The head snippets are inserted verbatim.
+			continue
+		}
+		if noPlaceholders[key] && (strings.ContainsAny(value, "*$") || strings.Contains(value, "{{")) {
+			errorf(n, sectionName, "%s does not support placeholders", key)
+		} else if strings.Contains(value, "{{") {
+			if _, err := parseExpr(value); err != nil {
+				hint := ""
+				if strings.Contains(l, "{{") && strings.Contains(l[strings.Index(l, "{{"):], `"`) {
+					hint = " (double quotes are removed from values; write strings in backquotes)"
+				}
+				errorf(n, sectionName, "%s: %v%s", key, err, hint)
+			}
+		} else if msg := vetPlaceholders(value); msg != "" {
+			errorf(n, sectionName, "%s: %s", key, msg)
+		}
+	}
+	return errs, refs
+}
+
+// vetPlaceholders checks the ``${NAME}'' placeholders in s, and reports
+// ``%b'' followed by a hex digit, which is more likely a percent-escape of
+// a URL than the placeholder.
+func vetPlaceholders(s string) string {
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '$' && i+1 < len(s) && s[i+1] == '$',
+			s[i] == '%' && i+1 < len(s) && s[i+1] == '%':
+			i++
+		case s[i] == '%' && i+2 < len(s) && s[i+1] == 'b' && strings.IndexByte("0123456789abcdefABCDEF", s[i+2]) >= 0:
+			return fmt.Sprintf("%s is replaced by the last part of the import path; write %%%s for a percent-escape", s[i:i+3], s[i:i+3])
+		case s[i] == '$' && i+1 < len(s) && s[i+1] == '{':
+			j := strings.IndexByte(s[i:], '}')
+			if j < 0 {
+				return "unterminated ${"
+			}
+			if j == 2 {
+				return "empty ${}"
+			}
+			i += j
+		}
+	}
+	return ""
+}
+
+// A sectionInfo describes a section of the configuration.
+type sectionInfo struct {
+	sub  bool            // takes a subsection name
+	vars map[string]bool // names of the variables
+}
+
+// configSections returns the sections of the configuration by name.
+func configSections() map[string]sectionInfo {
+	sections := make(map[string]sectionInfo)
+	t := reflect.TypeOf(config{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		var info sectionInfo
+		st := f.Type
+		if st.Kind() == reflect.Map {
+			info.sub = true
+			st = st.Elem()
+		}
+		if st.Kind() == reflect.Ptr {
+			st = st.Elem()
+		}
+		info.vars = make(map[string]bool)
+		for j := 0; j < st.NumField(); j++ {
+			v := st.Field(j)
+			if v.PkgPath != "" {
+				continue
+			}
+			name := v.Tag.Get("gcfg")
+			if name == "" {
+				name = v.Name
+			}
+			info.vars[strings.ToLower(strings.Replace(name, "_", "-", -1))] = true
+		}
+		sections[strings.ToLower(f.Name)] = info
+	}
+	return sections
+}
+
+// unquote returns the value v of a variable or subsection name without
+// quotes, escape sequences and trailing comments.
+func unquote(v string) string {
+	var sb strings.Builder
+	quoted := false
+	v = strings.TrimSpace(v)
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == '\\' && i+1 < len(v):
+			i++
+			switch v[i] {
+			case 'n':
+				sb.WriteByte('\n')
+			case 't':
+				sb.WriteByte('\t')
+			case 'b':
+				sb.WriteByte('\b')
+			default:
+				sb.WriteByte(v[i])
+			}
+		case !quoted && (c == ';' || c == '#'):
+			return strings.TrimSpace(sb.String())
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return strings.TrimSpace(sb.String())
+}
+
+// cmdVet runs the vet command.
+func cmdVet(args []string) {
+	if len(args) != 0 {
+		usage()
+	}
+	files, err := cfgfiles.files()
+	ckConfig(err)
+	ckConfig(readStdin(files))
+	errs := vetFiles(files)
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if len(errs) > 0 {
+		os.Exit(exitConfig)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVetPlaceholders(t *testing.T) {
+	tests := []struct {
+		s, want string // want is a substring of the message, or empty
+	}{
+		{"https://github.com/rtrn/$", ""},
+		{"https://${TOKEN}@example.com/*", ""},
+		{"$${NOT_A_PLACEHOLDER", ""},
+		{"https://example.com/%%b8", ""},
+		{"https://example.com/%b", ""},
+		{"https://example.com/%bx", ""},
+		{"https://${TOKEN", "unterminated"},
+		{"https://${}/", "empty"},
+		{"https://example.com/%e4%b8%ad", "%b8"},
+		{"https://example.com/%BF", ""},
+		{"https://example.com/%bF", "%bF"},
+	}
+	for _, tt := range tests {
+		got := vetPlaceholders(tt.s)
+		if tt.want == "" && got != "" || !strings.Contains(got, tt.want) {
+			t.Errorf("vetPlaceholders(%q) = %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestUnquote(t *testing.T) {
+	tests := []struct {
+		v, want string
+	}{
+		{" value ", "value"},
+		{`"quoted value"`, "quoted value"},
+		{`"a ; b" ; comment`, "a ; b"},
+		{"value # comment", "value"},
+		{`"tab\there"`, "tab\there"},
+		{`a\"b`, `a"b`},
+		{`"\\"`, `\`},
+		{`"cmd/govanity"`, "cmd/govanity"},
+		{`{{trimPrefix "tools/" .Path}}`, "{{trimPrefix tools/ .Path}}"},
+	}
+	for _, tt := range tests {
+		if got := unquote(tt.v); got != tt.want {
+			t.Errorf("unquote(%q) = %q, want %q", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestVet(t *testing.T) {
+	cfg := `[default]
+	root = rtrn.io
+	redirect = https://example.com/%e4%b8%ad
+[import "/cmd/govanity"]
+	repo = https://github.com/rtrn/govanity
+	colour = blue
+	repo = https://github.com/rtrn/{{trimPrefix "cmd/" .Path}}
+	head = <script>$(function() { $.ready({{.}}) }) // 100%b8</script>
+[import "/cmd/govanity"]
+[bogus]
+`
+	want := []string{
+		`x.cfg:3: [default]: redirect: %b8`,
+		`x.cfg:4: [import "/cmd/govanity"]: import path has a leading or trailing slash`,
+		`x.cfg:6: [import "/cmd/govanity"]: unknown variable "colour"`,
+		`x.cfg:7: [import "/cmd/govanity"]: repo: template:`,
+		`x.cfg:9: [import "/cmd/govanity"]: section defined twice (previously at line 4)`,
+		`x.cfg:9: [import "/cmd/govanity"]: import path has a leading or trailing slash`,
+		`x.cfg:10: unknown section "bogus"`,
+	}
+	errs, _ := vet("x.cfg", []byte(cfg), make(map[string]bool))
+	if len(errs) != len(want) {
+		t.Fatalf("vet: got %d errors, want %d:\n%v", len(errs), len(want), vetErrors(errs))
+	}
+	for i, err := range errs {
+		if !strings.HasPrefix(err.Error(), want[i]) {
+			t.Errorf("vet: error %d is %q, want prefix %q", i, err, want[i])
+		}
+	}
+}
+
+func TestVetProfiles(t *testing.T) {
+	dir := t.TempDir()
+	files := []string{filepath.Join(dir, "a.cfg"), filepath.Join(dir, "b.cfg")}
+	data := []string{`[default]
+	profile = github
+[import "cmd/govanity"]
+	profile = nosuch
+[import "cmd/uuenc"]
+	profile =
+`, `[profile "github"]
+	repo = https://github.com/rtrn/$
+`}
+	for i, f := range files {
+		if err := ioutil.WriteFile(f, []byte(data[i]), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := files[0] + `:4: [import "cmd/govanity"]: unknown profile "nosuch"`
+	errs := vetFiles(files)
+	if len(errs) != 1 || errs[0].Error() != want {
+		t.Errorf("vetFiles: got %v, want %s", vetErrors(errs), want)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// workspaceConfig is the [workspace] section, which lists the
+// directories to discover modules in.
+type workspaceConfig struct {
+	Dir []string
+}
+
+// discover adds an import to cfg for every module below the workspace
+// directories whose path starts with the root domain of the default section
+// and that is at the top of a git repository.  The repository is taken from
+// the remote ``origin'', and the directories are walked in the workspace.
+// Imports defined in the configuration take precedence.
+func discover(cfg *config) error {
+	if len(cfg.Workspace.Dir) == 0 {
+		return nil
+	}
+	if cfg.Default.Root == nil || *cfg.Default.Root == "" {
+		return fmt.Errorf("workspace: requires a root in the default section")
+	}
+	root := *cfg.Default.Root
+	if cfg.Import == nil {
+		cfg.Import = make(map[string]*entry)
+	}
+	for _, dir := range cfg.Workspace.Dir {
+		if strings.HasPrefix(dir, "~/") || strings.HasPrefix(dir, "~"+string(filepath.Separator)) {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return fmt.Errorf("workspace: %v", err)
+			}
+			dir = filepath.Join(home, dir[2:])
+		}
+		err := filepath.Walk(dir, func(f string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				name := info.Name()
+				if f != dir && (name == "vendor" || name == "testdata" || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if info.Name() != "go.mod" {
+				return nil
+			}
+			data, err := ioutil.ReadFile(f)
+			if err != nil {
+				return err
+			}
+			mod := modulePath(data)
+			if !strings.HasPrefix(mod, root+"/") {
+				return nil
+			}
+			k := strings.TrimPrefix(mod, root+"/")
+			if _, ok := cfg.Import[k]; ok {
+				return nil
+			}
+			d := filepath.Dir(f)
+			repo, err := gitRemote(d)
+			if err != nil {
+				warnf("workspace: skipping %s: %v", d, err)
+				return nil
+			}
+			if repo == "" {
+				// Nested modules are found by walking the top module.
+				return nil
+			}
+			cfg.Import[k] = &entry{Repo: &repo, src: d}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("workspace: %v", err)
+		}
+	}
+	return nil
+}
+
+// gitRemote returns the URL of the remote ``origin'' of the git repository
+// whose top directory is dir, or the empty string if dir is below the top.
+// URLs in the scp-like syntax, like git@github.com:rtrn/govanity.git, are
+// converted to https, and the suffix ``.git'' is removed.
+func gitRemote(dir string) (string, error) {
+	out, err := exec.Command("git", "-C", dir, "rev-parse", "--show-toplevel").Output()
+	if err != nil {
+		return "", fmt.Errorf("not a git repository")
+	}
+	top, err := filepath.EvalSymlinks(strings.TrimSpace(string(out)))
+	if err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(dir)
+	if err == nil {
+		abs, err = filepath.EvalSymlinks(abs)
+	}
+	if err != nil {
+		return "", err
+	}
+	if top != abs {
+		return "", nil
+	}
+	out, err = exec.Command("git", "-C", dir, "remote", "get-url", "origin").Output()
+	if err != nil {
+		return "", fmt.Errorf("no remote origin")
+	}
+	remote := strings.TrimSuffix(strings.TrimSpace(string(out)), ".git")
+	if !strings.Contains(remote, "://") {
+		if i := strings.IndexByte(remote, ':'); i >= 0 {
+			host := remote[:i]
+			if j := strings.IndexByte(host, '@'); j >= 0 {
+				host = host[j+1:]
+			}
+			remote = "https://" + host + "/" + remote[i+1:]
+		}
+	}
+	if _, err := url.Parse(remote); err != nil {
+		return "", err
+	}
+	return remote, nil
+}